@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"gitgud/logging"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+type accessEntryKey struct{}
+
+// Details of a request only its handlers know, filled in for its access log
+// line
+type accessEntry struct {
+	user       string
+	org        string
+	repository string
+	service    string
+
+	// Exit code of the git service, when one ran
+	exitCode    int
+	hasExitCode bool
+}
+
+// Entry of the access log line of request, one nobody reads when it isn't
+// being logged
+func accessEntryFromRequest(request *http.Request) *accessEntry {
+	entry, ok := request.Context().Value(accessEntryKey{}).(*accessEntry)
+	if !ok {
+		return &accessEntry{}
+	}
+
+	return entry
+}
+
+// Record the exit code of the git service run by command
+func (e *accessEntry) setExitCode(command *exec.Cmd) {
+	if command.ProcessState == nil {
+		return
+	}
+
+	e.exitCode = command.ProcessState.ExitCode()
+	e.hasExitCode = true
+}
+
+// Response writer keeping track of the status and bytes written
+type accessResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *accessResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *accessResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Request body keeping track of the bytes read
+type accessRequestBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *accessRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Log one line for every request once it has been answered. Each request
+// gets an ID, returned as X-Request-Id and logged by every slog call given
+// the context of the request.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+
+		id := newRequestID()
+		writer.Header().Set("X-Request-Id", id)
+
+		entry := &accessEntry{}
+		ctx := logging.WithAttrs(request.Context(), slog.String("request_id", id))
+		ctx = context.WithValue(ctx, accessEntryKey{}, entry)
+
+		body := &accessRequestBody{ReadCloser: request.Body}
+		request = request.WithContext(ctx)
+		request.Body = body
+
+		responseWriter := &accessResponseWriter{ResponseWriter: writer}
+		next.ServeHTTP(responseWriter, request)
+
+		status := responseWriter.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", request.Method),
+			slog.String("path", request.URL.Path),
+			slog.String("remote", request.RemoteAddr),
+			slog.Int("status", status),
+			slog.Int64("bytes_in", body.read),
+			slog.Int64("bytes_out", responseWriter.written),
+			slog.Duration("duration", time.Since(start)),
+		}
+
+		for _, attr := range []slog.Attr{
+			slog.String("user", entry.user),
+			slog.String("org", entry.org),
+			slog.String("repository", entry.repository),
+			slog.String("service", entry.service),
+		} {
+			if attr.Value.String() != "" {
+				attrs = append(attrs, attr)
+			}
+		}
+
+		if entry.hasExitCode {
+			attrs = append(attrs, slog.Int("exit_code", entry.exitCode))
+		}
+
+		slog.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+	})
+}
@@ -0,0 +1,40 @@
+// Package atomicfile replaces files so readers and crashes never see them
+// half written.
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write next to path and rename over it once write returns. The file is left
+// untouched when write fails, its error is returned as is.
+func Write(path string, write func(io.Writer) error) error {
+	temporary, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	err = write(temporary)
+	if err == nil {
+		err = temporary.Chmod(0600)
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporary.Name(), path)
+}
+
+// Replace path with contents
+func WriteFile(path string, contents []byte) error {
+	return Write(path, func(writer io.Writer) error {
+		_, err := writer.Write(contents)
+		return err
+	})
+}
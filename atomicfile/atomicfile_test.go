@@ -0,0 +1,74 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.json")
+
+	for _, contents := range []string{"first", "second"} {
+		err := WriteFile(path, []byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		written, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != contents {
+			t.Errorf("WriteFile() wrote %q, want %q", written, contents)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("WriteFile() mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestWrite_Failed(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "file.json")
+
+	err := WriteFile(path, []byte("kept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	err = Write(path, func(writer io.Writer) error {
+		_, err := writer.Write([]byte("partial"))
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("Write() error = %v, want the error of write", err)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "kept" {
+		t.Errorf("failed Write() left %q, want %q", written, "kept")
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("failed Write() left %d files behind, want 1", len(entries))
+	}
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"gitgud/config"
+	"gitgud/git"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type AccessLevel int
+
+const (
+	NoAccess AccessLevel = iota
+	ReadAccess
+	WriteAccess
+	AdminAccess
+)
+
+var accessLevelNames = map[AccessLevel]string{
+	NoAccess:    "none",
+	ReadAccess:  "read",
+	WriteAccess: "write",
+	AdminAccess: "admin",
+}
+
+func (l AccessLevel) String() string {
+	return accessLevelNames[l]
+}
+
+func ParseAccessLevel(name string) (AccessLevel, error) {
+	for level, levelName := range accessLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return NoAccess, fmt.Errorf("unknown access level %q", name)
+}
+
+// Access to a repository, read from git config entries such as
+//
+//	[access]
+//		default = read
+//	[access "alice"]
+//		level = write
+//
+// where the default applies to every authenticated user. In the org config
+//
+//	[access "bob"]
+//		create = true
+//
+// lets bob create repositories in the org, which org admins always may.
+type AccessPolicy struct {
+	Default  AccessLevel
+	Users    map[string]AccessLevel
+	Creators map[string]bool
+
+	// Whether Default was set, so an unset default doesn't override the one
+	// inherited from the org
+	hasDefault bool
+}
+
+func parseAccessPolicy(entries []git.ConfigEntry) (AccessPolicy, error) {
+	policy := AccessPolicy{Users: map[string]AccessLevel{}, Creators: map[string]bool{}}
+
+	for _, entry := range entries {
+		user, found := strings.CutPrefix(entry.Key, "access.")
+		if !found {
+			continue
+		}
+
+		if user, isCreate := strings.CutSuffix(user, ".create"); isCreate {
+			create, err := strconv.ParseBool(entry.Value)
+			if err != nil {
+				return AccessPolicy{}, fmt.Errorf("invalid %s: %w", entry.Key, err)
+			}
+			policy.Creators[user] = create
+			continue
+		}
+
+		user, isLevel := strings.CutSuffix(user, ".level")
+		if user != "default" && !isLevel {
+			continue
+		}
+
+		level, err := ParseAccessLevel(entry.Value)
+		if err != nil {
+			return AccessPolicy{}, fmt.Errorf("invalid %s: %w", entry.Key, err)
+		}
+
+		if user == "default" {
+			policy.Default = level
+			policy.hasDefault = true
+			continue
+		}
+
+		policy.Users[user] = level
+	}
+
+	return policy, nil
+}
+
+// Layer the policy of a repository over the defaults of its org. Repository
+// entries win, except that org admins stay admins of every repository.
+func (p AccessPolicy) Inherit(org AccessPolicy) AccessPolicy {
+	merged := AccessPolicy{
+		Default:    org.Default,
+		Users:      map[string]AccessLevel{},
+		Creators:   org.Creators,
+		hasDefault: org.hasDefault,
+	}
+
+	if p.hasDefault {
+		merged.Default = p.Default
+		merged.hasDefault = true
+	}
+
+	for user, level := range org.Users {
+		merged.Users[user] = level
+	}
+
+	for user, level := range p.Users {
+		if merged.Users[user] != AdminAccess {
+			merged.Users[user] = level
+		}
+	}
+
+	return merged
+}
+
+// Return the access level of an authenticated user
+func (p AccessPolicy) Level(user User) AccessLevel {
+	level, found := p.Users[user.Name]
+	if !found {
+		return p.Default
+	}
+
+	return level
+}
+
+func loadOrgAccessPolicy(ctx context.Context, remoteRepo git.GitRemoteRepository) (AccessPolicy, error) {
+	orgEntries, err := git.GetConfigFileRegexp(ctx, remoteRepo.OrgConfigPath(), `^access\.`)
+	if err != nil {
+		return AccessPolicy{}, err
+	}
+
+	orgPolicy, err := parseAccessPolicy(orgEntries)
+	if err != nil {
+		return AccessPolicy{}, fmt.Errorf("org %s: %w", remoteRepo.OrgName, err)
+	}
+
+	return orgPolicy, nil
+}
+
+// Load the access policy of a repository with the defaults of its org
+func LoadAccessPolicy(ctx context.Context, remoteRepo git.GitRemoteRepository) (AccessPolicy, error) {
+	orgPolicy, err := loadOrgAccessPolicy(ctx, remoteRepo)
+	if err != nil {
+		return AccessPolicy{}, err
+	}
+
+	repoEntries, err := remoteRepo.GetConfigRegexp(ctx, `^access\.`)
+	if err != nil {
+		return AccessPolicy{}, err
+	}
+
+	repoPolicy, err := parseAccessPolicy(repoEntries)
+	if err != nil {
+		return AccessPolicy{}, fmt.Errorf("repository %s/%s: %w", remoteRepo.OrgName, remoteRepo.Name, err)
+	}
+
+	return repoPolicy.Inherit(orgPolicy), nil
+}
+
+// Return the access level of user on the repository, nil for anonymous
+// clients. Missing repositories give NoAccess so their existence can't be
+// probed for.
+func RepositoryAccess(ctx context.Context, remoteRepo git.GitRemoteRepository, user *User) (AccessLevel, error) {
+	if _, err := os.Stat(remoteRepo.FullPath); err != nil {
+		return NoAccess, nil
+	}
+
+	anonymousRead, err := remoteRepo.GetConfigBool(ctx, "gitgud.anonymousRead", config.Settings.Auth.AnonymousRead)
+	if err != nil {
+		return NoAccess, fmt.Errorf("failed to check anonymous access: %w", err)
+	}
+
+	level := NoAccess
+	if anonymousRead {
+		level = ReadAccess
+	}
+
+	if user == nil {
+		return level, nil
+	}
+
+	policy, err := LoadAccessPolicy(ctx, remoteRepo)
+	if err != nil {
+		return NoAccess, err
+	}
+
+	return max(level, policy.Level(*user)), nil
+}
+
+// Return whether user may create the repository in its org, anonymous
+// clients never may.
+func CanCreateRepository(ctx context.Context, remoteRepo git.GitRemoteRepository, user *User) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+
+	orgPolicy, err := loadOrgAccessPolicy(ctx, remoteRepo)
+	if err != nil {
+		return false, err
+	}
+
+	return orgPolicy.Creators[user.Name] || orgPolicy.Level(*user) == AdminAccess, nil
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"gitgud/git"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessPolicy_Inherit(t *testing.T) {
+	org, err := parseAccessPolicy([]git.ConfigEntry{
+		{Key: "access.default", Value: "read"},
+		{Key: "access.owner.level", Value: "admin"},
+		{Key: "access.maintainer.level", Value: "write"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string // description of this test case
+		repoEntries []git.ConfigEntry
+		user        string
+		want        AccessLevel
+	}{
+		{
+			name: "org default inherited",
+			user: "somebody",
+			want: ReadAccess,
+		},
+		{
+			name:        "repository default overrides org default",
+			repoEntries: []git.ConfigEntry{{Key: "access.default", Value: "none"}},
+			user:        "somebody",
+			want:        NoAccess,
+		},
+		{
+			name:        "repository user overrides org user",
+			repoEntries: []git.ConfigEntry{{Key: "access.maintainer.level", Value: "read"}},
+			user:        "maintainer",
+			want:        ReadAccess,
+		},
+		{
+			name:        "org admin stays admin",
+			repoEntries: []git.ConfigEntry{{Key: "access.owner.level", Value: "none"}},
+			user:        "owner",
+			want:        AdminAccess,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := parseAccessPolicy(tt.repoEntries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := repo.Inherit(org).Level(User{Name: tt.user})
+			if got != tt.want {
+				t.Errorf("Level() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAccessLevel(t *testing.T) {
+	for _, level := range []AccessLevel{NoAccess, ReadAccess, WriteAccess, AdminAccess} {
+		got, err := ParseAccessLevel(level.String())
+		if err != nil || got != level {
+			t.Errorf("ParseAccessLevel(%q) = %v, %v, want %v", level.String(), got, err, level)
+		}
+	}
+
+	_, err := ParseAccessLevel("owner")
+	if err == nil {
+		t.Error("ParseAccessLevel() of unknown level succeeded unexpectedly")
+	}
+}
+
+func TestCanCreateRepository(t *testing.T) {
+	remoteRepo, err := git.NewRemoteRepository("", "test_org_create", "test_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(remoteRepo.OrgConfigPath()), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(remoteRepo.OrgConfigPath()))
+
+	orgConfig := "[access]\n\tdefault = write\n[access \"owner\"]\n\tlevel = admin\n[access \"creator\"]\n\tcreate = true\n"
+	err = os.WriteFile(remoteRepo.OrgConfigPath(), []byte(orgConfig), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string // description of this test case
+		user *User
+		want bool
+	}{
+		{name: "org admin", user: &User{Name: "owner"}, want: true},
+		{name: "allowed to create", user: &User{Name: "creator"}, want: true},
+		{name: "only write access", user: &User{Name: "somebody"}, want: false},
+		{name: "anonymous", user: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CanCreateRepository(context.Background(), remoteRepo, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("CanCreateRepository() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitgud/atomicfile"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordHash"`
+}
+
+// Users stored as JSON at Path. The file is read on every lookup so users can
+// be added and removed without a restart.
+type UserStore struct {
+	Path string
+
+	// Serializes writers, readers only ever see complete files
+	mu sync.Mutex
+}
+
+func NewUserStore(path string) *UserStore {
+	return &UserStore{Path: path}
+}
+
+func (s *UserStore) load() ([]User, error) {
+	contents, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []User{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users: %w", err)
+	}
+
+	var users []User
+	err = json.Unmarshal(contents, &users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse users %s: %w", s.Path, err)
+	}
+
+	return users, nil
+}
+
+func (s *UserStore) save(users []User) error {
+	contents, err := json.MarshalIndent(users, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode users: %w", err)
+	}
+
+	err = atomicfile.WriteFile(s.Path, contents)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", s.Path, err)
+	}
+
+	return nil
+}
+
+// Add a user or replace the password of an existing one
+func (s *UserStore) SetPassword(name, password string) error {
+	if name == "" || strings.ContainsAny(name, ": ") {
+		return fmt.Errorf("user name must not be empty or contain ':' or spaces")
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	user := User{Name: name, PasswordHash: string(passwordHash)}
+	index := slices.IndexFunc(users, func(u User) bool { return u.Name == name })
+	if index < 0 {
+		users = append(users, user)
+	} else {
+		users[index] = user
+	}
+
+	return s.save(users)
+}
+
+func (s *UserStore) DeleteUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	return s.save(slices.DeleteFunc(users, func(u User) bool { return u.Name == name }))
+}
+
+// Return the named user, ErrInvalidCredentials when there is no such user
+func (s *UserStore) Lookup(name string) (User, error) {
+	users, err := s.load()
+	if err != nil {
+		return User{}, err
+	}
+
+	index := slices.IndexFunc(users, func(u User) bool { return u.Name == name })
+	if index < 0 {
+		return User{}, ErrInvalidCredentials
+	}
+
+	return users[index], nil
+}
+
+// Hash passwords of unknown users are compared against, so they take as long
+// to turn away as wrong passwords and don't give away which users exist
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("gitgud"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+
+	return hash
+})
+
+// Check the password of the named user, ErrInvalidCredentials is returned for
+// unknown users as well as wrong passwords.
+func (s *UserStore) Authenticate(name, password string) (User, error) {
+	user, err := s.Lookup(name)
+	if errors.Is(err, ErrInvalidCredentials) {
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return User{}, err
+	}
+
+	if err != nil {
+		return User{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+type contextKey struct{}
+
+// Return a copy of ctx carrying the authenticated user
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// Return the authenticated user of ctx, false for anonymous requests
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(contextKey{}).(User)
+	return user, ok
+}
+
+type accessLevelKey struct{}
+
+// Return a copy of ctx carrying the access level granted to the request
+func WithAccessLevel(ctx context.Context, level AccessLevel) context.Context {
+	return context.WithValue(ctx, accessLevelKey{}, level)
+}
+
+// Return the access level granted to the request, NoAccess when none was
+func AccessLevelFromContext(ctx context.Context) AccessLevel {
+	level, _ := ctx.Value(accessLevelKey{}).(AccessLevel)
+	return level
+}
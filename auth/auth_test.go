@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserStore_Authenticate(t *testing.T) {
+	users := NewUserStore(filepath.Join(t.TempDir(), "users.json"))
+
+	err := users.SetPassword("nunya", "bidness")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string // description of this test case
+		user     string
+		password string
+		wantErr  error
+	}{
+		{
+			name:     "valid credentials",
+			user:     "nunya",
+			password: "bidness",
+			wantErr:  nil,
+		},
+		{
+			name:     "wrong password",
+			user:     "nunya",
+			password: "business",
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			name:     "unknown user",
+			user:     "somebody",
+			password: "bidness",
+			wantErr:  ErrInvalidCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := users.Authenticate(tt.user, tt.password)
+			if !errors.Is(gotErr, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", gotErr, tt.wantErr)
+			}
+			if gotErr == nil && got.Name != tt.user {
+				t.Errorf("Authenticate() = %v, want %v", got.Name, tt.user)
+			}
+		})
+	}
+
+	err = users.DeleteUser("nunya")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = users.Authenticate("nunya", "bidness")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate() after DeleteUser() error = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestUserStore_SetPassword_InvalidName(t *testing.T) {
+	users := NewUserStore(filepath.Join(t.TempDir(), "users.json"))
+
+	for _, name := range []string{"", "nunya bidness", "nunya:bidness"} {
+		err := users.SetPassword(name, "bidness")
+		if err == nil {
+			t.Errorf("SetPassword(%q) succeeded unexpectedly", name)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitgud/atomicfile"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid, expired or revoked token")
+
+type Scope string
+
+const (
+	ScopeRepoRead  Scope = "repo:read"
+	ScopeRepoWrite Scope = "repo:write"
+	ScopeAdmin     Scope = "admin"
+)
+
+var scopeLevels = map[Scope]AccessLevel{
+	ScopeRepoRead:  ReadAccess,
+	ScopeRepoWrite: WriteAccess,
+	ScopeAdmin:     AdminAccess,
+}
+
+func ParseScope(name string) (Scope, error) {
+	scope := Scope(name)
+	if _, found := scopeLevels[scope]; !found {
+		return "", fmt.Errorf("unknown scope %q", name)
+	}
+
+	return scope, nil
+}
+
+// Secrets start with a fixed prefix so they can be told apart from passwords
+// and picked up by secret scanners
+const tokenPrefix = "gitgud_"
+
+// How often the last used time is written back, so busy tokens don't
+// rewrite the store on every request
+const lastUsedResolution = time.Minute
+
+// Personal access token, only the hash of the secret is ever stored
+type Token struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Name       string    `json:"name"`
+	SecretHash string    `json:"secretHash"`
+	Scopes     []Scope   `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitzero"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitzero"`
+}
+
+// Highest access level the scopes of the token allow
+func (t Token) MaxLevel() AccessLevel {
+	level := NoAccess
+	for _, scope := range t.Scopes {
+		level = max(level, scopeLevels[scope])
+	}
+
+	return level
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)
+}
+
+// Whether the secret has the shape of a personal access token
+func IsToken(secret string) bool {
+	return strings.HasPrefix(secret, tokenPrefix)
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Tokens stored as JSON at Path, read on every lookup like the UserStore.
+// When they were last used is kept apart at LastUsedPath, recording a use
+// never writes Path and can't undo a token revoked meanwhile by another
+// process.
+type TokenStore struct {
+	Path         string
+	LastUsedPath string
+
+	mu sync.Mutex
+}
+
+func NewTokenStore(path string) *TokenStore {
+	return &TokenStore{Path: path, LastUsedPath: path + ".last_used"}
+}
+
+func (s *TokenStore) load() ([]Token, error) {
+	contents, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Token{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %w", err)
+	}
+
+	var tokens []Token
+	err = json.Unmarshal(contents, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tokens %s: %w", s.Path, err)
+	}
+
+	return tokens, nil
+}
+
+func (s *TokenStore) save(tokens []Token) error {
+	contents, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	err = atomicfile.WriteFile(s.Path, contents)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", s.Path, err)
+	}
+
+	return nil
+}
+
+// Return when each token was last used by ID
+func (s *TokenStore) loadLastUsed() (map[string]time.Time, error) {
+	contents, err := os.ReadFile(s.LastUsedPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]time.Time{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token last used times: %w", err)
+	}
+
+	lastUsed := map[string]time.Time{}
+	err = json.Unmarshal(contents, &lastUsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token last used times %s: %w", s.LastUsedPath, err)
+	}
+
+	return lastUsed, nil
+}
+
+func (s *TokenStore) saveLastUsed(lastUsed map[string]time.Time) error {
+	contents, err := json.MarshalIndent(lastUsed, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode token last used times: %w", err)
+	}
+
+	err = atomicfile.WriteFile(s.LastUsedPath, contents)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", s.LastUsedPath, err)
+	}
+
+	return nil
+}
+
+// Set the last used time of every token from lastUsed
+func withLastUsed(tokens []Token, lastUsed map[string]time.Time) []Token {
+	for i, token := range tokens {
+		if usedAt := lastUsed[token.ID]; usedAt.After(token.LastUsedAt) {
+			tokens[i].LastUsedAt = usedAt
+		}
+	}
+
+	return tokens
+}
+
+// Create a token for the user, the returned secret is the only time it is
+// available in plain text. A zero expiresAt never expires.
+func (s *TokenStore) Create(user, name string, scopes []Scope, expiresAt time.Time) (string, Token, error) {
+	if len(scopes) == 0 {
+		return "", Token{}, fmt.Errorf("token needs at least one scope")
+	}
+
+	secret := tokenPrefix + rand.Text()
+	token := Token{
+		ID:         rand.Text()[:8],
+		User:       user,
+		Name:       name,
+		SecretHash: hashSecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  expiresAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.load()
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	err = s.save(append(tokens, token))
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	return secret, token, nil
+}
+
+// Return the tokens of the user, every token when user is empty
+func (s *TokenStore) List(user string) ([]Token, error) {
+	tokens, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	lastUsed, err := s.loadLastUsed()
+	if err != nil {
+		return nil, err
+	}
+	tokens = withLastUsed(tokens, lastUsed)
+
+	if user == "" {
+		return tokens, nil
+	}
+
+	return slices.DeleteFunc(tokens, func(t Token) bool { return t.User != user }), nil
+}
+
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	remaining := slices.DeleteFunc(slices.Clone(tokens), func(t Token) bool { return t.ID == id })
+	if len(remaining) == len(tokens) {
+		return fmt.Errorf("no token with id %s", id)
+	}
+
+	return s.save(remaining)
+}
+
+// Return the token with the secret and record that it was used
+func (s *TokenStore) Authenticate(secret string) (Token, error) {
+	if !IsToken(secret) {
+		return Token{}, ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.load()
+	if err != nil {
+		return Token{}, err
+	}
+
+	secretHash := hashSecret(secret)
+	index := slices.IndexFunc(tokens, func(t Token) bool { return t.SecretHash == secretHash })
+	if index < 0 {
+		return Token{}, ErrInvalidToken
+	}
+
+	now := time.Now().UTC()
+	if tokens[index].Expired(now) {
+		return Token{}, ErrInvalidToken
+	}
+
+	lastUsed, err := s.loadLastUsed()
+	if err != nil {
+		return Token{}, err
+	}
+	token := withLastUsed(tokens[index:index+1], lastUsed)[0]
+
+	if now.Sub(token.LastUsedAt) >= lastUsedResolution {
+		token.LastUsedAt = now
+
+		// Revoked tokens are forgotten on the way
+		for id := range lastUsed {
+			if !slices.ContainsFunc(tokens, func(t Token) bool { return t.ID == id }) {
+				delete(lastUsed, id)
+			}
+		}
+		lastUsed[token.ID] = now
+
+		err = s.saveLastUsed(lastUsed)
+		if err != nil {
+			return Token{}, err
+		}
+	}
+
+	return token, nil
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenStore(t *testing.T) {
+	tokens := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+
+	secret, token, err := tokens.Create("nunya", "ci", []Scope{ScopeRepoRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsToken(secret) {
+		t.Errorf("IsToken(%q) = false, want true", secret)
+	}
+
+	if token.SecretHash == "" || strings.Contains(token.SecretHash, secret) {
+		t.Errorf("token stores %q for secret %q, want a hash", token.SecretHash, secret)
+	}
+
+	before, err := os.ReadFile(tokens.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tokens.Authenticate(secret)
+	if err != nil {
+		t.Fatalf("Authenticate() failed: %v", err)
+	}
+
+	// Tokens revoked by another process meanwhile must stay revoked
+	after, err := os.ReadFile(tokens.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("Authenticate() rewrote %s", tokens.Path)
+	}
+
+	if got.User != "nunya" || got.MaxLevel() != ReadAccess {
+		t.Errorf("Authenticate() = %v with level %v, want nunya with level %v", got.User, got.MaxLevel(), ReadAccess)
+	}
+
+	if got.LastUsedAt.IsZero() {
+		t.Error("Authenticate() did not record the last use")
+	}
+
+	listed, err := tokens.List("nunya")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || !listed[0].LastUsedAt.Equal(got.LastUsedAt) {
+		t.Errorf("List() = %v, want the token last used at %v", listed, got.LastUsedAt)
+	}
+
+	_, err = tokens.Authenticate(secret + "x")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of unknown secret error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	err = tokens.Revoke(token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tokens.Authenticate(secret)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of revoked token error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestTokenStore_Expired(t *testing.T) {
+	tokens := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+
+	secret, _, err := tokens.Create("nunya", "ci", []Scope{ScopeRepoWrite}, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tokens.Authenticate(secret)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of expired token error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestToken_MaxLevel(t *testing.T) {
+	tests := []struct {
+		name   string // description of this test case
+		scopes []Scope
+		want   AccessLevel
+	}{
+		{
+			name:   "read",
+			scopes: []Scope{ScopeRepoRead},
+			want:   ReadAccess,
+		},
+		{
+			name:   "read and write",
+			scopes: []Scope{ScopeRepoRead, ScopeRepoWrite},
+			want:   WriteAccess,
+		},
+		{
+			name:   "admin",
+			scopes: []Scope{ScopeAdmin},
+			want:   AdminAccess,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Token{Scopes: tt.scopes}.MaxLevel()
+			if got != tt.want {
+				t.Errorf("MaxLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/config"
+	"gitgud/protection"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Administrative subcommands, run instead of the server when gitgud is
+// started with arguments.
+//
+//	gitgud passwd <user>   set the password of a user from stdin, creating it
+//	gitgud deluser <user>  remove a user
+//	gitgud token create <user> <name> <scope,...> [days]
+//	                       create a personal access token, valid for days
+//	gitgud token list [user]
+//	gitgud token revoke <id>
+//	gitgud hook update <ref> <old> <new>
+//	                       enforce branch protection, run by receive-pack
+func runCommand(args []string) error {
+	users := auth.NewUserStore(config.Settings.Auth.UsersPath)
+	tokens := auth.NewTokenStore(config.Settings.Auth.TokensPath)
+
+	switch args[0] {
+	case "passwd":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: gitgud passwd <user>")
+		}
+
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return fmt.Errorf("password must not be empty")
+		}
+
+		return users.SetPassword(args[1], password)
+	case "deluser":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: gitgud deluser <user>")
+		}
+
+		return users.DeleteUser(args[1])
+	case "token":
+		return runTokenCommand(users, tokens, args[1:])
+	case "hook":
+		if len(args) != 5 || args[1] != "update" {
+			return fmt.Errorf("usage: gitgud hook update <ref> <old> <new>")
+		}
+
+		return protection.RunUpdateHook(context.Background(), args[2], args[3], args[4])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func runTokenCommand(users *auth.UserStore, tokens *auth.TokenStore, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gitgud token create|list|revoke")
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 4 || len(args) > 5 {
+			return fmt.Errorf("usage: gitgud token create <user> <name> <scope,...> [days]")
+		}
+
+		_, err := users.Lookup(args[1])
+		if err != nil {
+			return fmt.Errorf("unknown user %s", args[1])
+		}
+
+		var scopes []auth.Scope
+		for _, name := range strings.Split(args[3], ",") {
+			scope, err := auth.ParseScope(name)
+			if err != nil {
+				return err
+			}
+			scopes = append(scopes, scope)
+		}
+
+		var expiresAt time.Time
+		if len(args) == 5 {
+			days, err := strconv.Atoi(args[4])
+			if err != nil || days <= 0 {
+				return fmt.Errorf("invalid number of days %q", args[4])
+			}
+			expiresAt = time.Now().UTC().AddDate(0, 0, days)
+		}
+
+		secret, token, err := tokens.Create(args[1], args[2], scopes, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Created token %s, it won't be shown again:\n", token.ID)
+		fmt.Println(secret)
+		return nil
+	case "list":
+		user := ""
+		if len(args) > 1 {
+			user = args[1]
+		}
+
+		userTokens, err := tokens.List(user)
+		if err != nil {
+			return err
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tUSER\tNAME\tSCOPES\tEXPIRES\tLAST USED")
+		for _, token := range userTokens {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				token.ID,
+				token.User,
+				token.Name,
+				token.Scopes,
+				formatTime(token.ExpiresAt, "never"),
+				formatTime(token.LastUsedAt, "never"),
+			)
+		}
+		return writer.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: gitgud token revoke <id>")
+		}
+
+		return tokens.Revoke(args[1])
+	default:
+		return fmt.Errorf("unknown token command: %s", args[0])
+	}
+}
+
+func formatTime(t time.Time, zero string) string {
+	if t.IsZero() {
+		return zero
+	}
+
+	return t.Format(time.DateTime)
+}
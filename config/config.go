@@ -3,7 +3,9 @@ package config
 import (
 	"log/slog"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var Settings AppSettings
@@ -14,8 +16,11 @@ func init() {
 	if testing.Testing() {
 		appEnv = "test"
 	}
-	slog.Info("settings config", "coniguration", appEnv)
 	Settings = getSettings(appEnv)
+
+	// Logged once the level is set, hooks run this binary and anything logged
+	// ends up in the output of git push
+	slog.Debug("settings config", "coniguration", appEnv)
 }
 
 func getSettings(appEnv string) AppSettings {
@@ -43,9 +48,179 @@ type AppSettings struct {
 	RepositoriesLocation string
 	ClonesLocation       string
 	Debug                bool
+	LogLevel             slog.Level
 	AppEnv               AppEnv
 	DefaultBranch        string
 	BaseURL              string
+	Server               ServerSettings
+	SSH                  SSHSettings
+	Daemon               DaemonSettings
+	Auth                 AuthSettings
+	Webhooks             WebhookSettings
+	LFS                  LFSSettings
+	Timeouts             TimeoutSettings
+	Limits               LimitSettings
+}
+
+type ServerSettings struct {
+	// Git wire protocol versions a client may negotiate through the
+	// Git-Protocol header. Version 0 is the original protocol.
+	ProtocolVersions []int
+
+	// Serve the read-only dumb HTTP protocol to clients that don't speak the
+	// smart one. Repositories can override this with gitgud.dumbHttp.
+	DumbHTTP bool
+
+	// Create missing repositories when a user allowed to create repositories
+	// in the org pushes to them
+	PushToCreate bool
+
+	// How long a repository created for a push waits for it to land before
+	// it is removed again, zero to keep it. Repositories are checked every
+	// timeout, and on the next push to them.
+	PushToCreateTimeout time.Duration
+
+	// How long running requests and git services get to finish on SIGTERM
+	// or SIGINT before they are cancelled
+	ShutdownGracePeriod time.Duration
+
+	// How long /readyz fails on SIGTERM or SIGINT before the listeners are
+	// closed, for load balancers to stop sending new requests. Zero closes
+	// them right away.
+	ShutdownDrainDelay time.Duration
+
+	// Plain HTTP listen address, empty to not listen on plain HTTP
+	Address string
+
+	// Unix socket to serve plain HTTP on for a local reverse proxy, empty
+	// for none
+	SocketPath string
+
+	TLS TLSSettings
+
+	// Listen address serving /metrics and nothing else, empty to not serve
+	// metrics. The counters name private repositories, keep it out of reach
+	// of anyone but the scraper.
+	MetricsAddress string
+
+	// Negotiate HTTP/2 with clients over TLS
+	HTTP2 bool
+
+	// Answer on Address with redirects to HTTPS when TLS is on
+	RedirectHTTP bool
+
+	// Path every route is mounted under, e.g. /gitgud, empty for the root
+	BasePath string
+
+	// Proxies trusted to say which URL clients used through the
+	// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers,
+	// as CIDRs or addresses. "unix" trusts whatever connects to SocketPath.
+	// X-Forwarded-Prefix is the part of the path the proxy stripped, the
+	// requests it passes on still start with BasePath.
+	TrustedProxies []string
+}
+
+// BasePath with a leading slash and no trailing one
+func (s ServerSettings) MountPath() string {
+	return strings.TrimSuffix("/"+strings.Trim(s.BasePath, "/"), "/")
+}
+
+type TLSSettings struct {
+	// HTTPS is served on Address when a certificate is set. The pair is
+	// loaded again whenever one of the files changes.
+	Address  string
+	CertPath string
+	KeyPath  string
+}
+
+type SSHSettings struct {
+	// Accept git pushes and pulls over ssh:// on Address
+	Enabled bool
+	Address string
+
+	// Private host key, generated on first start when it doesn't exist
+	HostKeyPath string
+
+	// Public keys allowed to connect in OpenSSH authorized_keys format. Each
+	// key names the user it belongs to with a gitgud-user="name" option.
+	AuthorizedKeysPath string
+}
+
+type AuthSettings struct {
+	// JSON file holding the users allowed to authenticate over HTTP
+	UsersPath string
+
+	// JSON file holding the hashed personal access tokens
+	TokensPath string
+
+	// Allow clones and fetches without credentials for repositories that
+	// don't set gitgud.anonymousRead. Pushes always need a user.
+	AnonymousRead bool
+}
+
+type DaemonSettings struct {
+	// Serve anonymous read-only clones over git:// on Address
+	Enabled bool
+	Address string
+
+	// Export every repository anonymous clients may read instead of only
+	// the ones containing a git-daemon-export-ok file
+	ExportAll bool
+}
+
+type WebhookSettings struct {
+	// Directory holding the pending deliveries and the delivery log, pending
+	// deliveries survive a restart
+	QueuePath string
+
+	// Deliveries are retried with exponential backoff starting at RetryDelay
+	// and given up on after MaxAttempts
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	// How long a receiver gets to answer a delivery
+	Timeout time.Duration
+
+	// How often the queue is checked for deliveries that are due
+	PollInterval time.Duration
+}
+
+type LFSSettings struct {
+	// Directory holding the Git LFS objects and locks of every repository,
+	// laid out like RepositoriesLocation
+	StoragePath string
+}
+
+// Longest the git services may run for a single request or connection before
+// they are cancelled, zero for no limit. Services are also cancelled when the
+// client goes away.
+type TimeoutSettings struct {
+	// Ref advertisements of either service
+	AdvertiseRefs time.Duration
+
+	// Fetches and clones
+	UploadPack time.Duration
+
+	// Pushes, including the hooks they run
+	ReceivePack time.Duration
+}
+
+type LimitSettings struct {
+	// Most fetches and pushes served at once over every listener, zero for
+	// no limit. Pushes to the same repository always run one at a time.
+	UploadPack  int
+	ReceivePack int
+
+	// Requests over a limit wait in a queue of at most QueueLength for up to
+	// QueueTimeout. Those turned away are told to retry after RetryAfter.
+	QueueLength  int
+	QueueTimeout time.Duration
+	RetryAfter   time.Duration
+}
+
+// URL the routes are reachable at when no trusted proxy says otherwise
+func (s AppSettings) MountURL() string {
+	return strings.TrimSuffix(s.BaseURL, "/") + s.Server.MountPath()
 }
 
 func BaseSettings() AppSettings {
@@ -55,9 +230,59 @@ func BaseSettings() AppSettings {
 		Debug:                false,
 		DefaultBranch:        "main",
 		BaseURL:              "https://gitgud.com",
+		Server: ServerSettings{
+			ProtocolVersions:    []int{0, 1, 2},
+			PushToCreateTimeout: 10 * time.Minute,
+			ShutdownGracePeriod: 30 * time.Second,
+			Address:             "0.0.0.0:1323",
+			MetricsAddress:      "127.0.0.1:1324",
+			TLS: TLSSettings{
+				Address: "0.0.0.0:1443",
+			},
+			HTTP2: true,
+		},
+		SSH: SSHSettings{
+			Enabled:            false,
+			Address:            "0.0.0.0:2222",
+			HostKeyPath:        "ssh_host_ed25519_key",
+			AuthorizedKeysPath: "authorized_keys",
+		},
+		Daemon: DaemonSettings{
+			Enabled:   false,
+			Address:   "0.0.0.0:9418",
+			ExportAll: false,
+		},
+		Auth: AuthSettings{
+			UsersPath:     "users.json",
+			TokensPath:    "tokens.json",
+			AnonymousRead: false,
+		},
+		Webhooks: WebhookSettings{
+			QueuePath:    "webhooks",
+			MaxAttempts:  5,
+			RetryDelay:   30 * time.Second,
+			Timeout:      10 * time.Second,
+			PollInterval: 5 * time.Second,
+		},
+		LFS: LFSSettings{
+			StoragePath: "lfs_objects",
+		},
+		Timeouts: TimeoutSettings{
+			AdvertiseRefs: 30 * time.Second,
+			UploadPack:    time.Hour,
+			ReceivePack:   time.Hour,
+		},
+		Limits: LimitSettings{
+			UploadPack:   32,
+			ReceivePack:  16,
+			QueueLength:  64,
+			QueueTimeout: 30 * time.Second,
+			RetryAfter:   10 * time.Second,
+		},
 	}
 
-	slog.SetLogLoggerLevel(slog.LevelInfo)
+	settings.LogLevel = slog.LevelInfo
+	slog.SetLogLoggerLevel(settings.LogLevel)
 
 	return settings
 }
@@ -67,7 +292,8 @@ func DevelopmentSettings() AppSettings {
 	settings.AppEnv = Development
 	settings.Debug = false
 
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+	settings.LogLevel = slog.LevelDebug
+	slog.SetLogLoggerLevel(settings.LogLevel)
 
 	return settings
 }
@@ -82,6 +308,11 @@ func TestSettings() AppSettings {
 	settings := DevelopmentSettings()
 	settings.RepositoriesLocation = "test_repositories"
 	settings.ClonesLocation = "test_clones"
+	settings.Auth.UsersPath = "test_users.json"
+	settings.Auth.TokensPath = "test_tokens.json"
+	settings.Webhooks.QueuePath = "test_webhooks"
+	settings.LFS.StoragePath = "test_lfs_objects"
+	settings.Limits.QueueTimeout = 100 * time.Millisecond
 	settings.AppEnv = Testing
 	settings.Debug = true
 	return settings
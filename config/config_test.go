@@ -1,6 +1,7 @@
 package config
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -34,8 +35,7 @@ func TestBaseSettings(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got := getSettings(tt.env)
-			// TODO: update the condition below to compare got with tt.want.
-			if got != tt.want {
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("BaseSettings() = %v, want %v", got, tt.want)
 			}
 		})
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/config"
+	"gitgud/git"
+	"gitgud/limit"
+	"gitgud/pktline"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Marks a repository created by a push with the time it was created, until
+// that push has landed
+const pushCreatedKey = "gitgud.pushCreated"
+
+// Create a missing repository on the ref advertisement of a push when
+// push-to-create is enabled and the user, authenticated by identify, may
+// create repositories in the org. The creator becomes admin of the new
+// repository, which sweepAbandonedRepositories removes again when nothing is
+// pushed to it within PushToCreateTimeout. Everything else passes straight
+// through to next, which answers for missing repositories.
+func createOnPush(next errorHandler) errorHandler {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		if !config.Settings.Server.PushToCreate || requestedService(request) != "git-receive-pack" {
+			return next(writer, request)
+		}
+
+		remoteRepo, err := remoteRepositoryFromRequest(request)
+		if err != nil {
+			return next(writer, request)
+		}
+
+		// Repositories left behind by a push that never landed are removed
+		// first, without waiting for the next sweep
+		err = removeAbandonedRepository(request.Context(), remoteRepo, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(remoteRepo.FullPath); err == nil {
+			return next(writer, request)
+		}
+
+		user := requestUser(request)
+		if user == nil || auth.AccessLevelFromContext(request.Context()) < auth.WriteAccess {
+			return next(writer, request)
+		}
+
+		allowed, err := auth.CanCreateRepository(request.Context(), remoteRepo, user)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			return next(writer, request)
+		}
+
+		err = createRepository(request.Context(), remoteRepo, *user)
+		if err != nil {
+			return err
+		}
+
+		return next(writer, request)
+	}
+}
+
+func createRepository(ctx context.Context, remoteRepo git.GitRemoteRepository, creator auth.User) error {
+	err := remoteRepo.CreateBareRepo(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range [][2]string{
+		{fmt.Sprintf("access.%s.level", creator.Name), auth.AdminAccess.String()},
+		{pushCreatedKey, time.Now().UTC().Format(time.RFC3339)},
+	} {
+		err = remoteRepo.SetConfig(ctx, entry[0], entry[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.InfoContext(ctx, "repository created by push", "org", remoteRepo.OrgName, "repository", remoteRepo.Name, "user", creator.Name)
+	return nil
+}
+
+// Return when the repository was created by a push that hasn't landed yet,
+// false for repositories without a push pending. Unreadable times are zero.
+func pushCreatedAt(ctx context.Context, remoteRepo git.GitRemoteRepository) (time.Time, bool, error) {
+	entries, err := remoteRepo.GetConfigRegexp(ctx, `^gitgud\.pushcreated$`)
+	if err != nil || len(entries) == 0 {
+		return time.Time{}, false, err
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, entries[len(entries)-1].Value)
+	return createdAt, true, nil
+}
+
+// Settle a repository created by a push once the push is over. It stays,
+// without the marker, when refs landed and is removed otherwise. Returns
+// whether it stays.
+func settlePushCreated(ctx context.Context, remoteRepo git.GitRemoteRepository) (bool, error) {
+	refs, err := remoteRepo.GetRefs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if len(refs) > 0 {
+		return true, remoteRepo.UnsetConfig(ctx, pushCreatedKey)
+	}
+
+	slog.InfoContext(ctx, "removing repository nothing was pushed to", "org", remoteRepo.OrgName, "repository", remoteRepo.Name)
+	return false, remoteRepo.DeleteRepo(ctx)
+}
+
+// Remove a repository created by a push that hasn't landed within
+// PushToCreateTimeout of now. The repository is held like a push meanwhile,
+// so a push still running isn't pulled out from under it.
+func removeAbandonedRepository(ctx context.Context, remoteRepo git.GitRemoteRepository, now time.Time) error {
+	timeout := config.Settings.Server.PushToCreateTimeout
+	abandoned := func() (bool, error) {
+		if _, err := os.Stat(remoteRepo.FullPath); err != nil || timeout <= 0 {
+			return false, nil
+		}
+
+		createdAt, pending, err := pushCreatedAt(ctx, remoteRepo)
+		return pending && now.Sub(createdAt) >= timeout, err
+	}
+
+	found, err := abandoned()
+	if err != nil || !found {
+		return err
+	}
+
+	release, err := limit.DefaultServices().Acquire(ctx, "git-receive-pack", remoteRepo)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// A push may have landed while waiting
+	found, err = abandoned()
+	if err != nil || !found {
+		return err
+	}
+
+	_, err = settlePushCreated(ctx, remoteRepo)
+	return err
+}
+
+// Remove every repository created by a push that hasn't landed within
+// PushToCreateTimeout of now. Clients that never follow the advertisement
+// with a push, because they had nothing to push or gave up, leave them
+// behind.
+func sweepAbandonedRepositories(ctx context.Context, now time.Time) error {
+	remoteRepos, err := git.ListRemoteRepositories(config.Settings.BaseURL, "")
+	if err != nil {
+		return err
+	}
+
+	for _, remoteRepo := range remoteRepos {
+		err = removeAbandonedRepository(ctx, remoteRepo, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sweep abandoned repositories every PushToCreateTimeout, forever. They are
+// gone at most twice the timeout after they were created.
+func runAbandonedRepositorySweeps(ctx context.Context) {
+	ticker := time.NewTicker(config.Settings.Server.PushToCreateTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := sweepAbandonedRepositories(ctx, now)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to remove abandoned repositories", "error", err)
+			}
+		}
+	}
+}
+
+// Read the first command of a push to find out whether the client asked for
+// a sideband, returning a reader that still yields the whole request.
+func pushUsesSideband(body io.Reader) (bool, io.Reader, error) {
+	var consumed bytes.Buffer
+	packet, err := pktline.NewReader(io.TeeReader(body, &consumed)).ReadPacket()
+	if err != nil {
+		return false, nil, badRequest(fmt.Errorf("invalid push request: %w", err))
+	}
+
+	_, capabilities, _ := strings.Cut(string(packet.Data), "\x00")
+	sideband := slices.ContainsFunc(strings.Fields(capabilities), func(capability string) bool {
+		return capability == "side-band" || capability == "side-band-64k"
+	})
+
+	return sideband, io.MultiReader(&consumed, body), nil
+}
+
+// Writer holding back the flush that ends the response of receive-pack, so
+// messages can still be sent on the sideband after the push report.
+type creationAnnouncer struct {
+	writer io.Writer
+	tail   []byte
+}
+
+func (a *creationAnnouncer) Write(p []byte) (int, error) {
+	a.tail = append(a.tail, p...)
+	if len(a.tail) <= 4 {
+		return len(p), nil
+	}
+
+	_, err := a.writer.Write(a.tail[:len(a.tail)-4])
+	a.tail = slices.Clone(a.tail[len(a.tail)-4:])
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Tell the client where the repository lives and end the response
+func (a *creationAnnouncer) Announce(remoteRepo git.GitRemoteRepository) error {
+	if string(a.tail) == "0000" {
+		progress := pktline.NewWriter(a.writer).Sideband(pktline.SidebandProgress)
+		_, err := fmt.Fprintf(progress, "\nCreated repository %s/%s, it can be cloned from:\n  %s\n\n", remoteRepo.OrgName, remoteRepo.Name, remoteRepo.CloneURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.Close()
+}
+
+// End the response without announcing anything
+func (a *creationAnnouncer) Close() error {
+	_, err := a.writer.Write(a.tail)
+	a.tail = nil
+	return err
+}
@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/config"
+	"gitgud/git"
+	"gitgud/limit"
+	"gitgud/netserver"
+	"gitgud/pktline"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Server for anonymous read-only clones over the native git:// protocol.
+type Server struct {
+	Settings config.DaemonSettings
+
+	netserver.Server
+}
+
+// Repositories are only exported when they contain this file, unless the
+// ExportAll setting is on and they allow anonymous reads. Same marker git
+// daemon uses.
+const exportMarker = "git-daemon-export-ok"
+
+// Time a client gets to send its request line
+const requestTimeout = 10 * time.Second
+
+func NewServer(settings config.DaemonSettings) *Server {
+	return &Server{Settings: settings}
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Settings.Address)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Listening for git://", "address", listener.Addr())
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	return s.Server.Serve(listener, s.handleConnection)
+}
+
+type request struct {
+	Service     string
+	Path        string
+	Host        string
+	GitProtocol string
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	reader := bufio.NewReader(conn)
+	daemonRequest, err := readRequest(reader)
+	if err != nil {
+		slog.Debug("invalid git daemon request", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	slog.Info("git daemon request",
+		"remote", conn.RemoteAddr(),
+		"service", daemonRequest.Service,
+		"path", daemonRequest.Path,
+		"host", daemonRequest.Host,
+	)
+
+	if daemonRequest.Service != "git-upload-pack" {
+		writeError(conn, "service not enabled")
+		return
+	}
+
+	remoteRepo, err := git.NewRemoteRepositoryFromPath(config.Settings.MountURL(), daemonRequest.Path)
+	if err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+
+	// Missing and unexported repositories get the same answer so the
+	// protocol can't be used to probe for private repositories
+	if !s.exported(s.Context(), remoteRepo) {
+		writeError(conn, fmt.Sprintf("repository '%s' not exported", daemonRequest.Path))
+		return
+	}
+
+	protocolVersion, err := git.NegotiateProtocolVersion(daemonRequest.Service, daemonRequest.GitProtocol, config.Settings.Server.ProtocolVersions)
+	if err != nil {
+		writeError(conn, err.Error())
+		return
+	}
+	remoteRepo.ProtocolVersion = protocolVersion
+
+	services := limit.DefaultServices()
+
+	release, err := services.Acquire(s.Context(), daemonRequest.Service, remoteRepo)
+	if err != nil {
+		writeError(conn, fmt.Sprintf("server busy, try again in %s", services.Settings.RetryAfter))
+		return
+	}
+	defer release()
+
+	ctx, cancel := git.WithServiceTimeout(s.Context(), daemonRequest.Service, false)
+	defer cancel()
+
+	command := remoteRepo.CallServiceStream(ctx, daemonRequest.Service)
+	command.Stdout = conn
+
+	// Copy stdin by hand so the service isn't held open by a client that
+	// keeps its side of the connection open
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		slog.Error("failed to open service stdin", "error", err)
+		return
+	}
+
+	wait, err := git.Start(command)
+	if err != nil {
+		slog.Error("failed to start service", "service", daemonRequest.Service, "error", err)
+		return
+	}
+
+	go func() {
+		io.Copy(stdin, reader)
+		stdin.Close()
+	}()
+
+	err = wait()
+
+	if cause := context.Cause(ctx); cause != nil {
+		slog.Info("git daemon service cancelled", "service", daemonRequest.Service, "path", remoteRepo.FullPath, "reason", cause)
+		return
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		slog.Error("failure calling service", "service", daemonRequest.Service, "error", err)
+	}
+}
+
+func (s *Server) exported(ctx context.Context, remoteRepo git.GitRemoteRepository) bool {
+	info, err := os.Stat(remoteRepo.FullPath)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+
+	_, err = os.Stat(filepath.Join(remoteRepo.FullPath, exportMarker))
+	if err == nil {
+		return true
+	}
+
+	if !s.Settings.ExportAll {
+		return false
+	}
+
+	// Clients are anonymous, exporting everything mustn't expose the
+	// repositories that need credentials
+	level, err := auth.RepositoryAccess(ctx, remoteRepo, nil)
+	if err != nil {
+		slog.Error("failed to check anonymous access", "path", remoteRepo.FullPath, "error", err)
+		return false
+	}
+
+	return level >= auth.ReadAccess
+}
+
+// Read the pkt-line request sent when a client connects, e.g.
+// git-upload-pack /org/repo.git\0host=example.com\0\0version=2\0
+func readRequest(reader io.Reader) (request, error) {
+	packet, err := pktline.NewReader(reader).ReadPacket()
+	if err != nil {
+		return request{}, fmt.Errorf("failed to read request: %w", err)
+	}
+
+	if packet.Type != pktline.Data || len(packet.Data) == 0 {
+		return request{}, fmt.Errorf("unexpected %s packet instead of a request", packet.Type)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(packet.Data), "\x00"), "\x00")
+
+	var daemonRequest request
+	var found bool
+	daemonRequest.Service, daemonRequest.Path, found = strings.Cut(strings.TrimSuffix(fields[0], "\n"), " ")
+	if !found {
+		return request{}, fmt.Errorf("invalid request %q", fields[0])
+	}
+
+	// The host parameter comes first, extra parameters follow after an
+	// empty field
+	var extraParameters []string
+	for i, field := range fields[1:] {
+		if field == "" {
+			extraParameters = fields[i+2:]
+			break
+		}
+
+		if host, found := strings.CutPrefix(field, "host="); found {
+			daemonRequest.Host = host
+		}
+	}
+	daemonRequest.GitProtocol = strings.Join(extraParameters, ":")
+
+	return daemonRequest, nil
+}
+
+// Send an error the client shows as "remote error"
+func writeError(writer io.Writer, message string) {
+	err := pktline.NewWriter(writer).WriteError(message)
+	if err != nil {
+		slog.Debug("failed to send git daemon error", "error", err)
+	}
+}
@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"gitgud/config"
+	"gitgud/git"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name    string // description of this test case
+		line    string
+		want    request
+		wantErr bool
+	}{
+		{
+			name: "upload-pack with host",
+			line: "003bgit-upload-pack /test_org/test_repo.git\x00host=localhost\x00",
+			want: request{
+				Service: "git-upload-pack",
+				Path:    "/test_org/test_repo.git",
+				Host:    "localhost",
+			},
+		},
+		{
+			name: "upload-pack with version 2",
+			line: "0046git-upload-pack /test_org/test_repo.git\x00host=localhost\x00\x00version=2\x00",
+			want: request{
+				Service:     "git-upload-pack",
+				Path:        "/test_org/test_repo.git",
+				Host:        "localhost",
+				GitProtocol: "version=2",
+			},
+		},
+		{
+			name:    "invalid length",
+			line:    "zzzzgit-upload-pack /test_org/test_repo.git\x00",
+			wantErr: true,
+		},
+		{
+			name:    "flush instead of a request",
+			line:    "0000",
+			wantErr: true,
+		},
+		{
+			name:    "missing path",
+			line:    "0014git-upload-pack\x00",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := readRequest(strings.NewReader(tt.line))
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("readRequest() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("readRequest() succeeded unexpectedly")
+			}
+			if got != tt.want {
+				t.Errorf("readRequest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Clone(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go NewServer(config.DaemonSettings{}).Serve(listener)
+
+	testRepo, err := git.NewRemoteRepository("", "test_org", "test_repo_daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	cloneURL := fmt.Sprintf("git://%s/test_org/test_repo_daemon.git", listener.Addr())
+
+	output, err := exec.Command("git", "clone", cloneURL, t.TempDir()).CombinedOutput()
+	if err == nil {
+		t.Fatalf("clone of unexported repository succeeded: %s", output)
+	}
+
+	if !strings.Contains(string(output), "not exported") {
+		t.Errorf("clone output -> expected 'not exported' error, got %s", output)
+	}
+
+	err = os.WriteFile(filepath.Join(testRepo.FullPath, exportMarker), nil, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err = exec.Command("git", "clone", cloneURL, t.TempDir()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("clone of exported repository failed: %s", output)
+	}
+
+	output, err = exec.Command("git", "push", cloneURL, "HEAD:main").CombinedOutput()
+	if err == nil {
+		t.Fatalf("push over git:// succeeded: %s", output)
+	}
+}
+
+func TestServer_ExportAll(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go NewServer(config.DaemonSettings{ExportAll: true}).Serve(listener)
+
+	testRepo, err := git.NewRemoteRepository("", "test_org", "test_repo_daemon_all")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	cloneURL := fmt.Sprintf("git://%s/test_org/test_repo_daemon_all.git", listener.Addr())
+
+	output, err := exec.Command("git", "clone", cloneURL, t.TempDir()).CombinedOutput()
+	if err == nil {
+		t.Fatalf("clone of private repository succeeded: %s", output)
+	}
+
+	if !strings.Contains(string(output), "not exported") {
+		t.Errorf("clone output -> expected 'not exported' error, got %s", output)
+	}
+
+	err = testRepo.SetConfig(context.Background(), "gitgud.anonymousRead", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err = exec.Command("git", "clone", cloneURL, t.TempDir()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("clone of anonymously readable repository failed: %s", output)
+	}
+}
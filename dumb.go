@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"gitgud/config"
+	"gitgud/git"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Handlers for the dumb HTTP protocol. Everything is served read-only
+// straight from the bare repository, pushing over dumb HTTP needs WebDAV and
+// is not supported.
+
+var (
+	looseObjectDirectory = regexp.MustCompile(`^[0-9a-f]{2}$`)
+	looseObjectFile      = regexp.MustCompile(`^[0-9a-f]{38}$|^[0-9a-f]{62}$`)
+	packFile             = regexp.MustCompile(`^pack-(?:[0-9a-f]{40}|[0-9a-f]{64})\.(pack|idx)$`)
+)
+
+var packContentTypes = map[string]string{
+	"pack": "application/x-git-packed-objects",
+	"idx":  "application/x-git-packed-objects-toc",
+}
+
+// Resolve the repository for a dumb request, returning false when the dumb
+// protocol is disabled for it and the request has already been answered.
+func dumbRepositoryFromRequest(writer http.ResponseWriter, request *http.Request) (git.GitRemoteRepository, bool, error) {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return git.GitRemoteRepository{}, false, err
+	}
+
+	if _, err := os.Stat(remoteRepo.FullPath); err != nil {
+		http.NotFound(writer, request)
+		return git.GitRemoteRepository{}, false, nil
+	}
+
+	enabled, err := remoteRepo.GetConfigBool(request.Context(), "gitgud.dumbHttp", config.Settings.Server.DumbHTTP)
+	if err != nil {
+		return git.GitRemoteRepository{}, false, err
+	}
+
+	if !enabled {
+		http.Error(writer, "dumb HTTP transport is disabled for this repository", http.StatusForbidden)
+		return git.GitRemoteRepository{}, false, nil
+	}
+
+	return remoteRepo, true, nil
+}
+
+func DumbInfoRefsHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, ok, err := dumbRepositoryFromRequest(writer, request)
+	if !ok {
+		return err
+	}
+
+	infoRefs, err := remoteRepo.GetInfoRefs(request.Context())
+	if err != nil {
+		return err
+	}
+
+	noCache(writer)
+	writer.Header().Set("Content-Type", "text/plain")
+	_, err = writer.Write([]byte(infoRefs))
+	return err
+}
+
+func DumbInfoPacksHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, ok, err := dumbRepositoryFromRequest(writer, request)
+	if !ok {
+		return err
+	}
+
+	infoPacks, err := remoteRepo.GetInfoPacks()
+	if err != nil {
+		return err
+	}
+
+	noCache(writer)
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = writer.Write([]byte(infoPacks))
+	return err
+}
+
+// Serve HEAD, loose objects and pack files from the bare repository
+func DumbFileHandler(writer http.ResponseWriter, request *http.Request) error {
+	directory := request.PathValue("directory")
+	file := request.PathValue("file")
+
+	var path, contentType string
+	cacheable := true
+	switch {
+	case directory == "":
+		// Only the HEAD route comes without a directory
+		path = "HEAD"
+		contentType = "text/plain"
+		cacheable = false
+	case directory == "pack" && packFile.MatchString(file):
+		path = filepath.Join("objects", "pack", file)
+		contentType = packContentTypes[packFile.FindStringSubmatch(file)[1]]
+	case looseObjectDirectory.MatchString(directory) && looseObjectFile.MatchString(file):
+		path = filepath.Join("objects", directory, file)
+		contentType = "application/x-git-loose-object"
+	default:
+		http.NotFound(writer, request)
+		return nil
+	}
+
+	remoteRepo, ok, err := dumbRepositoryFromRequest(writer, request)
+	if !ok {
+		return err
+	}
+
+	contents, err := os.Open(filepath.Join(remoteRepo.FullPath, path))
+	if err != nil {
+		// Loose objects are expected to go missing once they are packed
+		http.NotFound(writer, request)
+		return nil
+	}
+	defer contents.Close()
+
+	info, err := contents.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	if cacheable {
+		// Objects are immutable once they have been written
+		cacheControl, err := immutableCacheControl(request.Context(), remoteRepo)
+		if err != nil {
+			return err
+		}
+		writer.Header().Set("Cache-Control", cacheControl)
+	} else {
+		noCache(writer)
+	}
+	writer.Header().Set("Content-Type", contentType)
+	http.ServeContent(writer, request, path, info.ModTime(), contents)
+	return nil
+}
+
+func noCache(writer http.ResponseWriter) {
+	writer.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	writer.Header().Set("Pragma", "no-cache")
+	writer.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitgud/git"
+	"gitgud/pktline"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error answered with Status. Message is what the client gets to see, the
+// wrapped error is only logged.
+type HTTPError struct {
+	Status  int
+	Message string
+	Err     error
+
+	// Set on the response along with the status
+	Header http.Header
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(err error) *HTTPError {
+	return &HTTPError{Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+func forbidden(err error) *HTTPError {
+	return &HTTPError{Status: http.StatusForbidden, Message: err.Error()}
+}
+
+func notFound(message string) *HTTPError {
+	return &HTTPError{Status: http.StatusNotFound, Message: message}
+}
+
+// Answer for requests turned away by a concurrency limit, telling clients
+// when to come back
+func serviceBusy(err error, retryAfter time.Duration) *HTTPError {
+	return &HTTPError{
+		Status:  http.StatusServiceUnavailable,
+		Message: "server busy, try again later",
+		Err:     err,
+		Header:  http.Header{"Retry-After": {strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))}},
+	}
+}
+
+// Status of requests whose client went away before they were answered, as
+// logged by nginx. Nobody is left to receive it.
+const statusClientClosedRequest = 499
+
+// Return the status and client message for err. Errors that aren't an
+// HTTPError are internal and their details stay in the logs.
+func errorResponse(err error) (int, string) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Status, httpErr.Message
+	}
+
+	return http.StatusInternalServerError, "internal server error"
+}
+
+// Set the headers err carries for the response
+func setErrorHeaders(writer http.ResponseWriter, err error) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return
+	}
+
+	for key, values := range httpErr.Header {
+		writer.Header()[key] = values
+	}
+}
+
+func logRequestError(request *http.Request, status int, err error) {
+	requestErrors.Inc(errorType(status, err))
+
+	if status >= http.StatusInternalServerError {
+		slog.ErrorContext(request.Context(), "Unexpected error in ServeHTTP", "method", request.Method, "path", request.URL.Path, "status", status, "error", err)
+		return
+	}
+
+	slog.InfoContext(request.Context(), "request failed", "method", request.Method, "path", request.URL.Path, "status", status, "error", err)
+}
+
+// Turn the failure of a git service into an error carrying the messages the
+// service wrote to stderr. The client sees the fatal and error lines, with
+// the location of the repository on disk left out. Services cancelled by
+// their timeout or by the client going away say so instead.
+func serviceError(ctx context.Context, service string, remoteRepo git.GitRemoteRepository, err error, stdErr string) error {
+	switch {
+	case errors.Is(context.Cause(ctx), git.ErrServiceTimeout):
+		return &HTTPError{
+			Status:  http.StatusServiceUnavailable,
+			Message: context.Cause(ctx).Error(),
+			Err:     fmt.Errorf("%w: %w: %s", err, context.Cause(ctx), strings.TrimSpace(stdErr)),
+		}
+	case ctx.Err() != nil:
+		return &HTTPError{
+			Status:  statusClientClosedRequest,
+			Message: fmt.Sprintf("%s cancelled", service),
+			Err:     fmt.Errorf("%w: %w", err, context.Cause(ctx)),
+		}
+	}
+
+	messages := []string{}
+	for _, line := range strings.Split(stdErr, "\n") {
+		for _, prefix := range []string{"fatal: ", "error: "} {
+			if message, found := strings.CutPrefix(line, prefix); found {
+				message = strings.ReplaceAll(message, remoteRepo.FullPath, remoteRepo.OrgName+"/"+remoteRepo.FullName)
+				messages = append(messages, message)
+			}
+		}
+	}
+
+	message := fmt.Sprintf("%s failed", service)
+	if len(messages) > 0 {
+		message = fmt.Sprintf("%s: %s", message, strings.Join(messages, "; "))
+	}
+
+	return &HTTPError{
+		Status:  http.StatusInternalServerError,
+		Message: message,
+		Err:     fmt.Errorf("%w: %s", err, strings.TrimSpace(stdErr)),
+	}
+}
+
+// Response writer remembering whether anything was written, once the body
+// has started the status can no longer change
+type serviceResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *serviceResponseWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Report errors of the smart HTTP service handlers the way git clients
+// understand them. Before anything is written a ref advertisement can still
+// fail with a status, git shows the message as "remote: ...". Inside the
+// exchange errors go out as an ERR packet, or on sideband 3 when the
+// response is already multiplexed, instead of leaving the client to report
+// "RPC failed".
+func gitService(next errorHandler) errorHandler {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		responseWriter := &serviceResponseWriter{ResponseWriter: writer}
+
+		err := next(responseWriter, request)
+		if err == nil {
+			return nil
+		}
+
+		service := requestedService(request)
+		isServicePost := request.Method == http.MethodPost && slices.Contains([]string{"git-upload-pack", "git-receive-pack"}, service)
+
+		// Clients turned away before the exchange started are told when to
+		// retry with a status, which git and any proxy in between understand
+		var httpErr *HTTPError
+		retry := errors.As(err, &httpErr) && httpErr.Header.Get("Retry-After") != ""
+
+		if !responseWriter.written && (!isServicePost || retry) {
+			return err
+		}
+
+		status, message := errorResponse(err)
+		logRequestError(request, status, err)
+
+		packetWriter := pktline.NewWriter(writer)
+		switch {
+		case !responseWriter.written:
+			writer.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+			packetWriter.WriteError(message)
+		case isServicePost:
+			// Every git since 1.6 negotiates a sideband, the pack and the
+			// push report are multiplexed by the time anything was written
+			fmt.Fprintf(packetWriter.Sideband(pktline.SidebandError), "%s\n", message)
+			packetWriter.WriteFlush()
+		default:
+			packetWriter.WriteError(message)
+		}
+
+		return nil
+	}
+}
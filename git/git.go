@@ -1,14 +1,29 @@
 package git
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gitgud/config"
+	"gitgud/metrics"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// How long a cancelled git command gets to clean up after SIGTERM before it
+// is killed
+const cancelWaitDelay = 5 * time.Second
+
+// Build the remote repository orgName/repoName, cloned from below baseURL,
+// the URL the HTTP routes are mounted at
 func NewRemoteRepository(baseURL, orgName, repoName string) (GitRemoteRepository, error) {
 	if strings.HasSuffix(repoName, ".git") {
 		return GitRemoteRepository{}, fmt.Errorf("%s must not end with '.git' as it is added automatically", repoName)
@@ -22,12 +37,21 @@ func NewRemoteRepository(baseURL, orgName, repoName string) (GitRemoteRepository
 		return GitRemoteRepository{}, fmt.Errorf("org name must not contain spaces")
 	}
 
+	// Names end up as path segments below RepositoriesLocation
+	if strings.Contains(repoName, "/") || strings.HasPrefix(repoName, ".") {
+		return GitRemoteRepository{}, fmt.Errorf("bare repository name must not contain '/' or start with '.'")
+	}
+
+	if strings.Contains(orgName, "/") || strings.HasPrefix(orgName, ".") {
+		return GitRemoteRepository{}, fmt.Errorf("org name must not contain '/' or start with '.'")
+	}
+
 	fullRepoName := repoName + ".git"
 	return GitRemoteRepository{
 		Name:     repoName,
 		OrgName:  orgName,
 		FullName: fullRepoName,
-		CloneURL: fmt.Sprintf("%s/git/%s/%s", baseURL, orgName, fullRepoName),
+		CloneURL: fmt.Sprintf("%s/%s/%s", baseURL, orgName, fullRepoName),
 
 		DefaultBranch: config.Settings.DefaultBranch,
 
@@ -40,6 +64,17 @@ func NewRemoteRepository(baseURL, orgName, repoName string) (GitRemoteRepository
 	}, nil
 }
 
+// Build the remote repository addressed by a path such as /org/repo.git, as
+// sent by clients over ssh:// and git://. The .git suffix is optional.
+func NewRemoteRepositoryFromPath(baseURL, path string) (GitRemoteRepository, error) {
+	orgName, repoName, found := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !found {
+		return GitRemoteRepository{}, fmt.Errorf("invalid repository path: %s", path)
+	}
+
+	return NewRemoteRepository(baseURL, orgName, strings.TrimSuffix(repoName, ".git"))
+}
+
 type GitRepository struct {
 	// Location of repo on filesystem
 	FullPath string
@@ -59,14 +94,99 @@ type GitRemoteRepository struct {
 	FullName      string
 	DefaultBranch string
 	CloneURL      string
+
+	// Wire protocol version negotiated with the client, 0 for the original
+	// protocol
+	ProtocolVersion int
 }
 
 type GitClonedRepository struct {
 	GitRepository
 }
 
-func (g GitRepository) Command(name string, arg ...string) (*exec.Cmd, *strings.Builder, *strings.Builder) {
-	command := exec.Command(name, arg...)
+// Build a command running under ctx. Commands still running when ctx is done
+// get SIGTERM, and are killed if they haven't exited cancelWaitDelay later.
+func (g GitRepository) commandContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	command := exec.CommandContext(ctx, name, arg...)
+
+	// SIGTERM lets git remove its lock files and quarantined objects
+	command.Cancel = func() error {
+		slog.WarnContext(ctx, "cancelling git command", "args", command.Args, "path", g.FullPath, "reason", context.Cause(ctx))
+		return command.Process.Signal(syscall.SIGTERM)
+	}
+	command.WaitDelay = cancelWaitDelay
+
+	return command
+}
+
+var (
+	commandDuration = metrics.Default.Histogram(
+		"gitgud_git_command_duration_seconds",
+		"Time git processes ran for, by subcommand.",
+		metrics.DurationBuckets,
+		"command",
+	)
+	commandsInFlight = metrics.Default.Gauge(
+		"gitgud_git_commands_in_flight",
+		"Git processes running, by subcommand.",
+		"command",
+	)
+	commandErrors = metrics.Default.Counter(
+		"gitgud_git_command_errors_total",
+		"Git processes that failed to start or were killed by a signal, by subcommand.",
+		"command", "type",
+	)
+)
+
+// Subcommand run by command, the program for anything other than git
+func commandLabel(command *exec.Cmd) string {
+	if filepath.Base(command.Path) == "git" && len(command.Args) > 1 {
+		return command.Args[1]
+	}
+
+	return filepath.Base(command.Path)
+}
+
+// Start command and count it as running until the returned wait function,
+// which waits for it like command.Wait, returns
+func Start(command *exec.Cmd) (func() error, error) {
+	label := commandLabel(command)
+
+	err := command.Start()
+	if err != nil {
+		commandErrors.Inc(label, "start")
+		return nil, err
+	}
+
+	commandsInFlight.Inc(label)
+	start := time.Now()
+
+	return func() error {
+		err := command.Wait()
+
+		commandsInFlight.Dec(label)
+		commandDuration.Observe(time.Since(start).Seconds(), label)
+		if command.ProcessState != nil && !command.ProcessState.Exited() {
+			commandErrors.Inc(label, "signal")
+		}
+
+		return err
+	}, nil
+}
+
+// Run command like command.Run, keeping the metrics of git processes
+func Run(command *exec.Cmd) error {
+	wait, err := Start(command)
+	if err != nil {
+		return err
+	}
+
+	return wait()
+}
+
+func (g GitRepository) Command(ctx context.Context, name string, arg ...string) (*exec.Cmd, *strings.Builder, *strings.Builder) {
+	command := g.commandContext(ctx, name, arg...)
+	command.Env = os.Environ()
 
 	if g.tracePacket {
 		command.Env = append(command.Env, "GIT_TRACE_PACKET=1")
@@ -93,6 +213,14 @@ type File struct {
 	Name string
 }
 
+type Commit struct {
+	ID          string
+	AuthorName  string
+	AuthorEmail string
+	Timestamp   time.Time
+	Message     string
+}
+
 type EmptyRepositoryError struct {
 	BranchName string
 }
@@ -102,10 +230,11 @@ func (e EmptyRepositoryError) Error() string {
 }
 
 // Return a slice of files from the given branch of the GitRepository
-func (g GitRepository) GetFiles(branchName string) ([]File, error) {
-	slog.Debug("getting files...")
+func (g GitRepository) GetFiles(ctx context.Context, branchName string) ([]File, error) {
+	slog.DebugContext(ctx, "getting files...")
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"ls-tree",
 		branchName,
@@ -115,19 +244,19 @@ func (g GitRepository) GetFiles(branchName string) ([]File, error) {
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
-	slog.Error(stdErr.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
 		if err.Error() == "exit status 128" && strings.Contains(stdErr.String(), fmt.Sprintf("fatal: Not a valid object name %s\n", branchName)) {
 			return []File{}, EmptyRepositoryError{branchName}
 		}
 
+		slog.ErrorContext(ctx, stdErr.String())
 		return []File{}, fmt.Errorf("failure looking for files in git repo: %s (%w)", stdErr.String(), err)
 	}
 
-	slog.Debug("files retrieved.")
+	slog.DebugContext(ctx, "files retrieved.")
 
 	files := strings.Split(stdOut.String(), "\n")
 	files = files[:len(files)-1]
@@ -141,10 +270,11 @@ func (g GitRepository) GetFiles(branchName string) ([]File, error) {
 
 // Create a new git remote (bare) repository at the configured FullPath.
 // Overwrite the DefaultBranch before calling this if required.
-func (g GitRemoteRepository) CreateBareRepo() error {
-	slog.Debug("creating repository", "path", g.FullPath)
+func (g GitRemoteRepository) CreateBareRepo(ctx context.Context) error {
+	slog.DebugContext(ctx, "creating repository", "path", g.FullPath)
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"init",
 		"--bare",
@@ -152,45 +282,93 @@ func (g GitRemoteRepository) CreateBareRepo() error {
 		g.FullPath,
 	)
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
-		slog.Error(stdErr.String())
+		slog.ErrorContext(ctx, stdErr.String())
 		return fmt.Errorf("failed to create bare repo: %w", err)
 	}
 
-	slog.Debug("repository created.")
+	slog.DebugContext(ctx, "repository created.")
 	return nil
 }
 
-func (g GitRemoteRepository) CallService(service string, advertiseRefs bool) *exec.Cmd {
-	slog.Debug("calling service", "service", service, "path", g.FullPath)
+// Location of the settings shared by all repositories of the org, in git
+// config format
+func (g GitRemoteRepository) OrgConfigPath() string {
+	return strings.Join([]string{config.Settings.RepositoriesLocation, g.OrgName, "gitgud.config"}, "/")
+}
+
+// Error a service was cancelled with once it ran past its timeout
+var ErrServiceTimeout = errors.New("service timed out")
+
+// Return a copy of ctx that is cancelled once service has run for as long as
+// config.Settings.Timeouts allows. The cancel function must be called when the
+// service is done.
+func WithServiceTimeout(ctx context.Context, service string, advertiseRefs bool) (context.Context, context.CancelFunc) {
+	timeouts := config.Settings.Timeouts
+
+	var timeout time.Duration
+	switch {
+	case advertiseRefs:
+		timeout = timeouts.AdvertiseRefs
+	case service == "git-upload-pack":
+		timeout = timeouts.UploadPack
+	case service == "git-receive-pack":
+		timeout = timeouts.ReceivePack
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%s: %w after %s", service, ErrServiceTimeout, timeout))
+}
 
-	var command *exec.Cmd
+func (g GitRemoteRepository) CallService(ctx context.Context, service string, advertiseRefs bool) *exec.Cmd {
 	if advertiseRefs {
-		command = exec.Command(
-			"git",
-			strings.Replace(service, "git-", "", 1),
+		return g.serviceCommand(
+			ctx,
+			service,
 			"--stateless-rpc",
 			"--advertise-refs",
 			"--http-backend-info-refs",
 			".",
 		)
-	} else {
-		command = exec.Command(
-			"git",
-			strings.Replace(service, "git-", "", 1),
-			"--stateless-rpc",
-			".",
-		)
 	}
 
-	slog.Debug("command", "args", command)
+	return g.serviceCommand(
+		ctx,
+		service,
+		"--stateless-rpc",
+		".",
+	)
+}
+
+// Call the service for a full duplex connection such as an SSH channel, the
+// refs are advertised and negotiated over the same process.
+func (g GitRemoteRepository) CallServiceStream(ctx context.Context, service string) *exec.Cmd {
+	return g.serviceCommand(ctx, service, ".")
+}
+
+func (g GitRemoteRepository) serviceCommand(ctx context.Context, service string, arg ...string) *exec.Cmd {
+	slog.DebugContext(ctx, "calling service", "service", service, "path", g.FullPath)
+
+	command := g.commandContext(
+		ctx,
+		"git",
+		append([]string{strings.Replace(service, "git-", "", 1)}, arg...)...,
+	)
+
+	slog.DebugContext(ctx, "command", "args", command)
 
 	command.Dir = g.FullPath
+	command.Env = os.Environ()
 
-	command.Env = append(command.Env, "GIT_PROTOCOL=version=2")
+	if g.ProtocolVersion > 0 {
+		command.Env = append(command.Env, fmt.Sprintf("GIT_PROTOCOL=version=%d", g.ProtocolVersion))
+	}
 
 	if g.tracePacket {
 		command.Env = append(command.Env, "GIT_TRACE_PACKET=1")
@@ -207,61 +385,105 @@ func (g GitRemoteRepository) CallService(service string, advertiseRefs bool) *ex
 	return command
 }
 
+// Pick the protocol version to speak from the value of a Git-Protocol header
+// (or GIT_PROTOCOL variable). The highest allowed version that is not above
+// the requested one wins, clients that don't ask for a version get version 0.
+// receive-pack has no version 2 so pushes top out at version 1.
+func NegotiateProtocolVersion(service, gitProtocol string, allowed []int) (int, error) {
+	requested := 0
+	for _, param := range strings.Split(gitProtocol, ":") {
+		value, found := strings.CutPrefix(param, "version=")
+		if !found {
+			continue
+		}
+
+		// Unknown versions are ignored the same way git itself does
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		requested = max(requested, version)
+	}
+
+	if service == "git-receive-pack" {
+		requested = min(requested, 1)
+	}
+
+	negotiated := -1
+	for _, version := range allowed {
+		if version <= requested && version > negotiated {
+			negotiated = version
+		}
+	}
+
+	if negotiated < 0 {
+		return 0, fmt.Errorf("protocol version %d is not allowed", requested)
+	}
+
+	return negotiated, nil
+}
+
 // Delete the remote repository if it exists.
-func (g GitRepository) DeleteRepo() error {
-	slog.Debug("attempting to delete", "path", g.FullPath)
+func (g GitRepository) DeleteRepo(ctx context.Context) error {
+	slog.DebugContext(ctx, "attempting to delete", "path", g.FullPath)
 
 	err := os.RemoveAll(g.FullPath)
+	if err != nil {
+		return fmt.Errorf("failed to delete repository: %w", err)
+	}
 
-	slog.Debug("deleted.")
-	return fmt.Errorf("failed to delete repository: %w", err)
+	slog.DebugContext(ctx, "deleted.")
+	return nil
 }
 
-func (g GitRepository) GetBranch() (string, error) {
-	slog.Debug("getting current branch...")
+// Return the branch HEAD points at, empty when HEAD is detached
+func (g GitRepository) GetBranch(ctx context.Context) (string, error) {
+	slog.DebugContext(ctx, "getting current branch...")
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"branch",
 		"--show-current",
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
-		slog.Error(stdErr.String())
+		slog.ErrorContext(ctx, stdErr.String())
 		return "", fmt.Errorf("failed to get branch: %w", err)
 	}
 
-	slog.Debug("branch retrieved.")
+	slog.DebugContext(ctx, "branch retrieved.")
 
-	// Remove trailing newline from branch output
-	return stdOut.String()[:stdOut.Len()-1], nil
+	// Nothing is printed when HEAD is detached
+	return strings.TrimSpace(stdOut.String()), nil
 }
 
-func (g GitRemoteRepository) Clone(destination string) (GitClonedRepository, error) {
+func (g GitRemoteRepository) Clone(ctx context.Context, destination string) (GitClonedRepository, error) {
 	clonePath := strings.Join([]string{config.Settings.ClonesLocation, g.OrgName, destination}, "/")
-	slog.Debug("cloning repository", "repo", g.CloneURL, "dest", clonePath)
+	slog.DebugContext(ctx, "cloning repository", "repo", g.CloneURL, "dest", clonePath)
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"clone",
 		g.CloneURL,
 		clonePath,
 	)
 
-	err := command.Run()
+	err := Run(command)
 
-	slog.Debug(stdOut.String())
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
-		slog.Error(stdErr.String())
+		slog.ErrorContext(ctx, stdErr.String())
 		return GitClonedRepository{}, fmt.Errorf("failed to clone repository: %w", err)
 	}
 
-	slog.Debug("repository cloned.")
+	slog.DebugContext(ctx, "repository cloned.")
 
 	clonedRepo := GitClonedRepository{
 		g.GitRepository,
@@ -271,56 +493,60 @@ func (g GitRemoteRepository) Clone(destination string) (GitClonedRepository, err
 	return clonedRepo, nil
 }
 
-func (g GitClonedRepository) AddAll() error {
-	slog.Debug("adding all files...")
+func (g GitClonedRepository) AddAll(ctx context.Context) error {
+	slog.DebugContext(ctx, "adding all files...")
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"add",
 		".",
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
+	err := Run(command)
 
-	slog.Debug(stdOut.String())
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
-		slog.Error(stdErr.String())
+		slog.ErrorContext(ctx, stdErr.String())
 		return fmt.Errorf("failed to add all: %w", err)
 	}
 
-	slog.Debug("all files added.")
+	slog.DebugContext(ctx, "all files added.")
 
 	return nil
 }
 
-func (g GitClonedRepository) GetConfig() (string, error) {
-	slog.Debug("getting config...")
+func (g GitRepository) GetConfig(ctx context.Context) (string, error) {
+	slog.DebugContext(ctx, "getting config...")
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"config",
+		"--local",
 		"--list",
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
 		return "", fmt.Errorf("failed to get config: %s (%w)", stdErr, err)
 	}
 
-	slog.Debug("Config retrieved.")
+	slog.DebugContext(ctx, "Config retrieved.")
 
 	return stdOut.String(), nil
 }
 
-func (g GitClonedRepository) SetConfig(key, value string) error {
-	slog.Debug("setting config...", "key", key, "value", value)
+func (g GitRepository) SetConfig(ctx context.Context, key, value string) error {
+	slog.DebugContext(ctx, "setting config...", "key", key, "value", value)
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"config",
 		key,
@@ -328,22 +554,75 @@ func (g GitClonedRepository) SetConfig(key, value string) error {
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
 		return fmt.Errorf("failed to set config: %s (%w)", stdErr, err)
 	}
 
-	slog.Debug("Config set.")
+	slog.DebugContext(ctx, "Config set.")
+
+	return nil
+}
+
+// Whether ancestor is an ancestor of (or the same commit as) descendant
+func (g GitRepository) IsAncestor(ctx context.Context, ancestor, descendant string) (bool, error) {
+	command, _, stdErr := g.Command(
+		ctx,
+		"git",
+		"merge-base",
+		"--is-ancestor",
+		ancestor,
+		descendant,
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to compare %s and %s: %s (%w)", ancestor, descendant, stdErr, err)
+	}
+
+	return true, nil
+}
+
+// Remove every value of the key, keys that aren't set are left alone
+func (g GitRepository) UnsetConfig(ctx context.Context, key string) error {
+	slog.DebugContext(ctx, "unsetting config...", "key", key)
+
+	command, _, stdErr := g.Command(
+		ctx,
+		"git",
+		"config",
+		"--unset-all",
+		key,
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	// Exit code 5 means the key wasn't set
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 5) {
+		return fmt.Errorf("failed to unset config: %s (%w)", stdErr, err)
+	}
+
+	slog.DebugContext(ctx, "Config unset.")
 
 	return nil
 }
 
-func (g GitClonedRepository) Commit(message string) error {
-	slog.Debug("committing...")
+func (g GitClonedRepository) Commit(ctx context.Context, message string) error {
+	slog.DebugContext(ctx, "committing...")
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"commit",
 		"-m",
@@ -351,37 +630,550 @@ func (g GitClonedRepository) Commit(message string) error {
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
-		slog.Error(stdErr.String())
+		slog.ErrorContext(ctx, stdErr.String())
 		return fmt.Errorf("failed to commit: %w", err)
 	}
 
-	slog.Debug("Committed.")
+	slog.DebugContext(ctx, "Committed.")
 
 	return nil
 }
 
-func (g GitClonedRepository) Push() error {
-	slog.Debug("pushing...")
+func (g GitClonedRepository) Push(ctx context.Context) error {
+	slog.DebugContext(ctx, "pushing...")
 
 	command, stdOut, stdErr := g.Command(
+		ctx,
 		"git",
 		"push",
 	)
 	command.Dir = g.FullPath
 
-	err := command.Run()
-	slog.Debug(stdOut.String())
+	err := Run(command)
+	slog.DebugContext(ctx, stdOut.String())
 
 	if err != nil {
-		slog.Error(stdErr.String())
+		slog.ErrorContext(ctx, stdErr.String())
 		return fmt.Errorf("failed to push: %w", err)
 	}
 
-	slog.Debug("pushed.")
+	slog.DebugContext(ctx, "pushed.")
 
 	return nil
 }
+
+type ConfigEntry struct {
+	Key   string
+	Value string
+}
+
+// Return the config entries of the repository with keys matching the regular
+// expression. Only the repository's own config is read, entries of the
+// global and system config files must not grant anything.
+func (g GitRepository) GetConfigRegexp(ctx context.Context, pattern string) ([]ConfigEntry, error) {
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"config",
+		"--local",
+		"--null",
+		"--get-regexp",
+		pattern,
+	)
+	command.Dir = g.FullPath
+
+	return runConfigRegexp(command, stdOut, stdErr)
+}
+
+// Return the entries with keys matching the regular expression from a
+// standalone file in git config format. A missing file has no entries.
+func GetConfigFileRegexp(ctx context.Context, path, pattern string) ([]ConfigEntry, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return []ConfigEntry{}, nil
+	}
+
+	var g GitRepository
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"config",
+		"--file",
+		path,
+		"--null",
+		"--get-regexp",
+		pattern,
+	)
+
+	return runConfigRegexp(command, stdOut, stdErr)
+}
+
+func runConfigRegexp(command *exec.Cmd, stdOut, stdErr *strings.Builder) ([]ConfigEntry, error) {
+	err := Run(command)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// Exit code 1 means nothing matched
+		return []ConfigEntry{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config: %s (%w)", stdErr, err)
+	}
+
+	// Entries come as key, newline, value and a terminating NUL
+	entries := []ConfigEntry{}
+	for _, entry := range strings.Split(strings.TrimSuffix(stdOut.String(), "\x00"), "\x00") {
+		if entry == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(entry, "\n")
+		entries = append(entries, ConfigEntry{key, value})
+	}
+
+	return entries, nil
+}
+
+// Return the value of a boolean config key of the repository's own config,
+// or fallback when it is unset there.
+func (g GitRepository) GetConfigBool(ctx context.Context, key string, fallback bool) (bool, error) {
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"config",
+		"--local",
+		"--type=bool",
+		"--get",
+		key,
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// Exit code 1 means the key isn't set
+		return fallback, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to get config %s: %s (%w)", key, stdErr, err)
+	}
+
+	return strings.TrimSpace(stdOut.String()) == "true", nil
+}
+
+// Return the refs of the repository in the format of the info/refs file used
+// by the dumb HTTP protocol, annotated tags are followed by their peeled value.
+func (g GitRepository) GetInfoRefs(ctx context.Context) (string, error) {
+	slog.DebugContext(ctx, "getting info refs...")
+
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"for-each-ref",
+		"--format=%(objectname)%09%(refname)%(if)%(*objectname)%(then)%0a%(*objectname)%09%(refname)^{}%(end)",
+		"refs/",
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get info refs: %s (%w)", stdErr, err)
+	}
+
+	slog.DebugContext(ctx, "info refs retrieved.")
+
+	return stdOut.String(), nil
+}
+
+// Return the packs of the repository in the format of the objects/info/packs
+// file used by the dumb HTTP protocol.
+func (g GitRepository) GetInfoPacks() (string, error) {
+	entries, err := os.ReadDir(filepath.Join(g.FullPath, "objects", "pack"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	var infoPacks strings.Builder
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".pack") {
+			fmt.Fprintf(&infoPacks, "P %s\n", entry.Name())
+		}
+	}
+	infoPacks.WriteString("\n")
+
+	return infoPacks.String(), nil
+}
+
+// Return the directory git runs the hooks of the repository from, which
+// follows core.hooksPath wherever git finds it. Relative paths are relative
+// to the repository.
+func (g GitRepository) HooksPath(ctx context.Context) (string, error) {
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"rev-parse",
+		"--git-path",
+		"hooks",
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+	if err != nil {
+		return "", fmt.Errorf("failed to find hooks path: %s (%w)", stdErr, err)
+	}
+
+	return strings.TrimSpace(stdOut.String()), nil
+}
+
+// Return every ref of the repository mapped to the object it points at
+func (g GitRepository) GetRefs(ctx context.Context) (map[string]string, error) {
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"for-each-ref",
+		"--format=%(objectname) %(refname)",
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refs: %s (%w)", stdErr, err)
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(stdOut.String()), "\n") {
+		objectID, refName, found := strings.Cut(line, " ")
+		if found {
+			refs[refName] = objectID
+		}
+	}
+
+	return refs, nil
+}
+
+// Return up to limit commits reachable from revision but not from any of the
+// excluded revisions, newest first.
+func (g GitRepository) GetCommits(ctx context.Context, revision string, exclude []string, limit int) ([]Commit, error) {
+	args := []string{
+		"log",
+		fmt.Sprintf("--max-count=%d", limit),
+		// Fields are NUL separated and commits end with a record separator
+		"--format=%H%x00%an%x00%ae%x00%aI%x00%B%x1e",
+		revision,
+	}
+	if len(exclude) > 0 {
+		args = append(args, "--not")
+		args = append(args, exclude...)
+	}
+
+	command, stdOut, stdErr := g.Command(ctx, "git", args...)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commits: %s (%w)", stdErr, err)
+	}
+
+	commits := []Commit{}
+	for _, record := range strings.Split(stdOut.String(), "\x1e") {
+		fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x00", 5)
+		if len(fields) != 5 {
+			continue
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit date %q: %w", fields[3], err)
+		}
+
+		commits = append(commits, Commit{
+			ID:          fields[0],
+			AuthorName:  fields[1],
+			AuthorEmail: fields[2],
+			Timestamp:   timestamp,
+			Message:     strings.TrimSpace(fields[4]),
+		})
+	}
+
+	return commits, nil
+}
+
+// Oldest git gitgud runs, repositories are created with --initial-branch
+const MinimumVersion = "2.28.0"
+
+// Version of the git found on the PATH, e.g. 2.39.5
+func Version(ctx context.Context) (string, error) {
+	command, stdOut, stdErr := GitRepository{}.Command(ctx, "git", "version")
+
+	err := Run(command)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get git version: %s (%w)", stdErr, err)
+	}
+
+	// git version 2.39.5, followed by the build on some platforms
+	fields := strings.Fields(stdOut.String())
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return "", fmt.Errorf("unexpected git version output %q", stdOut)
+	}
+
+	return fields[2], nil
+}
+
+// Check the git on the PATH is at least MinimumVersion, returning its version
+func CheckVersion(ctx context.Context) (string, error) {
+	version, err := Version(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if compareVersions(version, MinimumVersion) < 0 {
+		return version, fmt.Errorf("git %s is older than %s", version, MinimumVersion)
+	}
+
+	return version, nil
+}
+
+// Compare dotted versions number by number. Whatever follows the numbers,
+// like the .windows.1 of Git for Windows, is ignored.
+func compareVersions(a, b string) int {
+	numbers := func(version string) []int {
+		parsed := []int{}
+		for _, field := range strings.Split(version, ".") {
+			number, err := strconv.Atoi(field)
+			if err != nil {
+				break
+			}
+			parsed = append(parsed, number)
+		}
+		return parsed
+	}
+
+	return slices.Compare(numbers(a), numbers(b))
+}
+
+// Find the bare repositories below RepositoriesLocation, those of orgName or
+// of every org when it is empty. Directories starting with a dot, and orgs
+// whose directory doesn't exist, are skipped.
+func ListRemoteRepositories(baseURL, orgName string) ([]GitRemoteRepository, error) {
+	orgNames := []string{orgName}
+	if orgName == "" {
+		entries, err := os.ReadDir(config.Settings.RepositoriesLocation)
+		if errors.Is(err, fs.ErrNotExist) {
+			return []GitRemoteRepository{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list orgs: %w", err)
+		}
+
+		orgNames = []string{}
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				orgNames = append(orgNames, entry.Name())
+			}
+		}
+	}
+
+	remoteRepos := []GitRemoteRepository{}
+	for _, orgName := range orgNames {
+		entries, err := os.ReadDir(filepath.Join(config.Settings.RepositoriesLocation, orgName))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repositories of %s: %w", orgName, err)
+		}
+
+		for _, entry := range entries {
+			repoName, isRepo := strings.CutSuffix(entry.Name(), ".git")
+			if !entry.IsDir() || !isRepo {
+				continue
+			}
+
+			remoteRepo, err := NewRemoteRepository(baseURL, orgName, repoName)
+			if err != nil {
+				// Names the routes couldn't address, put there by hand
+				continue
+			}
+
+			remoteRepos = append(remoteRepos, remoteRepo)
+		}
+	}
+
+	return remoteRepos, nil
+}
+
+// What git init writes to the description file of new repositories
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// Description of the repository from its description file, empty when it has
+// none or still the one git init wrote
+func (g GitRepository) Description() (string, error) {
+	contents, err := os.ReadFile(filepath.Join(g.FullPath, "description"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read description: %w", err)
+	}
+
+	description := strings.TrimSpace(string(contents))
+	if description == defaultDescription {
+		return "", nil
+	}
+
+	return description, nil
+}
+
+// Time of the newest commit any branch points at, the zero time for empty
+// repositories
+func (g GitRepository) LastUpdated(ctx context.Context) (time.Time, error) {
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"for-each-ref",
+		"--sort=-committerdate",
+		"--count=1",
+		"--format=%(committerdate:iso-strict)",
+		"refs/heads",
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get last update: %s (%w)", stdErr, err)
+	}
+
+	output := strings.TrimSpace(stdOut.String())
+	if output == "" {
+		return time.Time{}, nil
+	}
+
+	updated, err := time.Parse(time.RFC3339, output)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid commit date %q: %w", output, err)
+	}
+
+	return updated, nil
+}
+
+// Kinds of tree entries, named after what they hold rather than the object
+// type git stores
+type TreeEntryType string
+
+const (
+	TreeEntryBlob      TreeEntryType = "blob"
+	TreeEntryTree      TreeEntryType = "tree"
+	TreeEntrySubmodule TreeEntryType = "submodule"
+	TreeEntrySymlink   TreeEntryType = "symlink"
+)
+
+type TreeEntry struct {
+	Name string
+
+	// Path from the root of the tree, without a leading slash
+	Path string
+
+	// Octal file mode as git stores it, e.g. 100644
+	Mode     string
+	Type     TreeEntryType
+	ObjectID string
+
+	// Size in bytes of blobs and symlinks, zero for trees and submodules
+	Size int64
+}
+
+type TreeNotFoundError struct {
+	Ref  string
+	Path string
+}
+
+func (e TreeNotFoundError) Error() string {
+	return fmt.Sprintf("no directory %q at %s", e.Path, e.Ref)
+}
+
+// Return the entries of the directory at path in the tree of ref, the root
+// directory when path is empty. Refs that don't exist, paths that aren't a
+// directory and empty repositories give a TreeNotFoundError.
+func (g GitRepository) GetTree(ctx context.Context, ref, path string) ([]TreeEntry, error) {
+	path = strings.Trim(path, "/")
+
+	// Refs never start with a dash, anything that does would be taken for
+	// an option
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return nil, TreeNotFoundError{ref, path}
+	}
+
+	command, stdOut, stdErr := g.Command(
+		ctx,
+		"git",
+		"ls-tree",
+		"--long",
+		"-z",
+		ref+":"+path,
+	)
+	command.Dir = g.FullPath
+
+	err := Run(command)
+
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 128 {
+			return nil, TreeNotFoundError{ref, path}
+		}
+
+		return nil, fmt.Errorf("failed to list tree: %s (%w)", stdErr, err)
+	}
+
+	entries := []TreeEntry{}
+	for _, record := range strings.Split(stdOut.String(), "\x00") {
+		if record == "" {
+			continue
+		}
+
+		// <mode> SP <type> SP <object> SP+ <size> TAB <name>
+		info, name, found := strings.Cut(record, "\t")
+		fields := strings.Fields(info)
+		if !found || len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected ls-tree output %q", record)
+		}
+
+		entry := TreeEntry{
+			Name:     name,
+			Path:     strings.TrimPrefix(path+"/"+name, "/"),
+			Mode:     fields[0],
+			ObjectID: fields[2],
+		}
+
+		switch {
+		case fields[1] == "tree":
+			entry.Type = TreeEntryTree
+		case fields[1] == "commit":
+			entry.Type = TreeEntrySubmodule
+		case fields[0] == "120000":
+			entry.Type = TreeEntrySymlink
+		default:
+			entry.Type = TreeEntryBlob
+		}
+
+		if fields[3] != "-" {
+			entry.Size, err = strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in ls-tree output %q: %w", record, err)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
@@ -1,11 +1,17 @@
 package git
 
 import (
+	"context"
 	"errors"
+	"gitgud/config"
 	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewRepository(t *testing.T) {
@@ -40,6 +46,18 @@ func TestNewRepository(t *testing.T) {
 			orgName:  "test org",
 			wantErr:  true,
 		},
+		{
+			name:     "invalid repo name with slash",
+			repoName: "../test",
+			orgName:  "test_org",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid org name starting with dot",
+			repoName: "test",
+			orgName:  "..",
+			wantErr:  true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -77,12 +95,12 @@ func TestGitRepository_CreateBareRepo(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			g, err := NewRemoteRepository(tt.baseURL, tt.orgName, tt.repoName)
-			defer g.DeleteRepo()
+			defer g.DeleteRepo(context.Background())
 
 			if err != nil {
 				t.Fatalf("could not construct receiver type: %v", err)
 			}
-			gotErr := g.CreateBareRepo()
+			gotErr := g.CreateBareRepo(context.Background())
 			if gotErr != nil {
 				if !tt.wantErr {
 					t.Errorf("CreateBareRepo() failed: %v", gotErr)
@@ -126,7 +144,7 @@ func TestGitRepository_Command(t *testing.T) {
 			// Don't need to worry about creating an actual git repository while
 			// just testing a generic command
 			var g GitRepository
-			gotCommand, gotStdOut, gotStdErr := g.Command(tt.name, tt.arg...)
+			gotCommand, gotStdOut, gotStdErr := g.Command(context.Background(), tt.name, tt.arg...)
 			gotCommand.Run()
 
 			if gotStdOut.String() != tt.wantStdOut {
@@ -146,13 +164,13 @@ func TestGitRepository_GetFiles_Empty(t *testing.T) {
 		t.Fatalf("could not construct receiver type: %v", err)
 	}
 
-	err = g.CreateBareRepo()
+	err = g.CreateBareRepo(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer g.DeleteRepo()
+	defer g.DeleteRepo(context.Background())
 
-	gotFiles, gotErr := g.GetFiles("main")
+	gotFiles, gotErr := g.GetFiles(context.Background(), "main")
 
 	if gotErr == nil {
 		t.Fatal("GetFiles() did not return error and should have")
@@ -167,3 +185,328 @@ func TestGitRepository_GetFiles_Empty(t *testing.T) {
 	}
 
 }
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name        string // description of this test case
+		service     string
+		gitProtocol string
+		allowed     []int
+		want        int
+		wantErr     bool
+	}{
+		{
+			name:        "no header",
+			gitProtocol: "",
+			allowed:     []int{0, 1, 2},
+			want:        0,
+		},
+		{
+			name:        "version 2 requested",
+			gitProtocol: "version=2",
+			allowed:     []int{0, 1, 2},
+			want:        2,
+		},
+		{
+			name:        "version 2 requested with other params",
+			gitProtocol: "object-format=sha1:version=2",
+			allowed:     []int{0, 1, 2},
+			want:        2,
+		},
+		{
+			name:        "version 2 requested but only 0 and 1 allowed",
+			gitProtocol: "version=2",
+			allowed:     []int{0, 1},
+			want:        1,
+		},
+		{
+			name:        "unknown version ignored",
+			gitProtocol: "version=banana",
+			allowed:     []int{0, 1, 2},
+			want:        0,
+		},
+		{
+			name:        "version 0 not allowed",
+			gitProtocol: "",
+			allowed:     []int{2},
+			wantErr:     true,
+		},
+		{
+			name:        "receive-pack version 2 requested",
+			service:     "git-receive-pack",
+			gitProtocol: "version=2",
+			allowed:     []int{0, 1, 2},
+			want:        1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := NegotiateProtocolVersion(tt.service, tt.gitProtocol, tt.allowed)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("NegotiateProtocolVersion() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("NegotiateProtocolVersion() succeeded unexpectedly")
+			}
+			if got != tt.want {
+				t.Errorf("NegotiateProtocolVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitRepository_GetConfigBool(t *testing.T) {
+	g, err := NewRemoteRepository("", "test_org", "test_repo_for_config")
+	if err != nil {
+		t.Fatalf("could not construct receiver type: %v", err)
+	}
+
+	err = g.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.DeleteRepo(context.Background())
+
+	got, err := g.GetConfigBool(context.Background(), "gitgud.unset", true)
+	if err != nil {
+		t.Fatalf("GetConfigBool() failed: %v", err)
+	}
+	if !got {
+		t.Errorf("GetConfigBool() of unset key = %v, want fallback %v", got, true)
+	}
+
+	err = g.SetConfig(context.Background(), "gitgud.set", "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = g.GetConfigBool(context.Background(), "gitgud.set", true)
+	if err != nil {
+		t.Fatalf("GetConfigBool() failed: %v", err)
+	}
+	if got {
+		t.Errorf("GetConfigBool() = %v, want %v", got, false)
+	}
+}
+
+func TestGitRepository_GetConfig_LocalOnly(t *testing.T) {
+	g, err := NewRemoteRepository("", "test_org", "test_repo_for_local_config")
+	if err != nil {
+		t.Fatalf("could not construct receiver type: %v", err)
+	}
+
+	err = g.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.DeleteRepo(context.Background())
+
+	// Entries of the server user's config apply to every repository
+	globalConfig := filepath.Join(t.TempDir(), "gitconfig")
+	err = os.WriteFile(globalConfig, []byte("[access \"mallory\"]\n\tlevel = admin\n[gitgud]\n\tanonymousRead = true\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", globalConfig)
+
+	entries, err := g.GetConfigRegexp(context.Background(), `^access\.`)
+	if err != nil {
+		t.Fatalf("GetConfigRegexp() failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("GetConfigRegexp() = %v, want no entries from the global config", entries)
+	}
+
+	got, err := g.GetConfigBool(context.Background(), "gitgud.anonymousRead", false)
+	if err != nil {
+		t.Fatalf("GetConfigBool() failed: %v", err)
+	}
+	if got {
+		t.Errorf("GetConfigBool() = %v, want the fallback instead of the global config", got)
+	}
+}
+
+func TestWithServiceTimeout(t *testing.T) {
+	timeouts := config.Settings.Timeouts
+	defer func() { config.Settings.Timeouts = timeouts }()
+	config.Settings.Timeouts.UploadPack = 100 * time.Millisecond
+	config.Settings.Timeouts.ReceivePack = 0
+
+	remoteRepo, err := NewRemoteRepository("http://localhost", "test_org", "test_repo_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := WithServiceTimeout(context.Background(), "git-upload-pack", false)
+	defer cancel()
+
+	start := time.Now()
+	command, _, _ := remoteRepo.Command(ctx, "sleep", "5")
+	err = command.Run()
+
+	if err == nil {
+		t.Fatal("expected the command to be cancelled")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("command ran for %s after its timeout", elapsed)
+	}
+
+	if cause := context.Cause(ctx); !errors.Is(cause, ErrServiceTimeout) {
+		t.Errorf("cause -> expected ErrServiceTimeout, got %v", cause)
+	}
+
+	untimedCtx, cancel := WithServiceTimeout(context.Background(), "git-receive-pack", false)
+	defer cancel()
+
+	if _, ok := untimedCtx.Deadline(); ok {
+		t.Error("expected no deadline when the timeout is zero")
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	version, err := CheckVersion(context.Background())
+	if err != nil {
+		t.Fatalf("CheckVersion() failed: %v", err)
+	}
+
+	if compareVersions(version, MinimumVersion) < 0 {
+		t.Errorf("CheckVersion() = %s, older than %s", version, MinimumVersion)
+	}
+}
+
+func Test_compareVersions(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"2.39.5", "2.28.0", 1},
+		{"2.28.0", "2.28.0", 0},
+		{"2.9.1", "2.28.0", -1},
+		{"2.45.1.windows.1", "2.28.0", 1},
+		{"2.28.0.rc1", "2.28.0", 0},
+		{"1.9.5", "2.28.0", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			got := compareVersions(tt.a, tt.b)
+			if got != tt.want {
+				t.Errorf("compareVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitRepository_GetTree(t *testing.T) {
+	g, err := NewRemoteRepository("", "test_org", "test_repo_for_gettree")
+	if err != nil {
+		t.Fatalf("could not construct receiver type: %v", err)
+	}
+
+	err = g.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.DeleteRepo(context.Background())
+
+	// Build the commit from plumbing, a clone can't hold a submodule
+	// without fetching it
+	git := func(stdin string, arg ...string) string {
+		t.Helper()
+
+		command, stdOut, stdErr := g.Command(context.Background(), "git", arg...)
+		command.Dir = g.FullPath
+		command.Stdin = strings.NewReader(stdin)
+		command.Env = append(command.Env,
+			"GIT_AUTHOR_NAME=Nunya Bidness", "GIT_AUTHOR_EMAIL=nunya@bidness.com",
+			"GIT_COMMITTER_NAME=Nunya Bidness", "GIT_COMMITTER_EMAIL=nunya@bidness.com",
+		)
+
+		err := Run(command)
+		if err != nil {
+			t.Fatalf("git %v: %s (%v)", arg, stdErr, err)
+		}
+
+		return strings.TrimSpace(stdOut.String())
+	}
+
+	readme := git("hello\n", "hash-object", "-w", "--stdin")
+	link := git("readme.md", "hash-object", "-w", "--stdin")
+	submodule := strings.Repeat("a", 40)
+	inner := git("100644 blob "+readme+"\tinner.txt\n", "mktree")
+	root := git(strings.Join([]string{
+		"100644 blob " + readme + "\treadme.md",
+		"120000 blob " + link + "\tlink",
+		"040000 tree " + inner + "\tdir",
+		"160000 commit " + submodule + "\tsub",
+	}, "\n")+"\n", "mktree")
+	commit := git("", "commit-tree", root, "-m", "Tree commit")
+	git("", "update-ref", "refs/heads/main", commit)
+
+	tests := []struct {
+		name    string // description of this test case
+		ref     string
+		path    string
+		want    []TreeEntry
+		wantErr bool
+	}{
+		{
+			name: "root",
+			ref:  "main",
+			want: []TreeEntry{
+				{Name: "dir", Path: "dir", Mode: "040000", Type: TreeEntryTree, ObjectID: inner},
+				{Name: "link", Path: "link", Mode: "120000", Type: TreeEntrySymlink, ObjectID: link, Size: 9},
+				{Name: "readme.md", Path: "readme.md", Mode: "100644", Type: TreeEntryBlob, ObjectID: readme, Size: 6},
+				{Name: "sub", Path: "sub", Mode: "160000", Type: TreeEntrySubmodule, ObjectID: submodule},
+			},
+		},
+		{
+			name: "subdirectory by commit",
+			ref:  commit,
+			path: "/dir/",
+			want: []TreeEntry{
+				{Name: "inner.txt", Path: "dir/inner.txt", Mode: "100644", Type: TreeEntryBlob, ObjectID: readme, Size: 6},
+			},
+		},
+		{
+			name:    "file instead of directory",
+			ref:     "main",
+			path:    "readme.md",
+			wantErr: true,
+		},
+		{
+			name:    "missing ref",
+			ref:     "missing",
+			wantErr: true,
+		},
+		{
+			name:    "option instead of ref",
+			ref:     "--output=oops",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotErr := g.GetTree(context.Background(), tt.ref, tt.path)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("GetTree() failed: %v", gotErr)
+				}
+				if !errors.As(gotErr, &TreeNotFoundError{}) {
+					t.Errorf("GetTree() = %v, want a TreeNotFoundError", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("GetTree() succeeded unexpectedly")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetTree() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitgud/config"
+	"gitgud/git"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Set once a shutdown starts, from then on readiness fails so load balancers
+// drain the server
+var shuttingDown atomic.Bool
+
+// Longest a readiness check may take, a storage that hangs is as good as
+// gone
+const readinessTimeout = 5 * time.Second
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Checks a server must pass to be sent traffic
+func readinessChecks(settings config.AppSettings) []readinessCheck {
+	return []readinessCheck{
+		{"git", func(ctx context.Context) error {
+			_, err := git.CheckVersion(ctx)
+			return err
+		}},
+		{"repositories", func(context.Context) error {
+			return checkWritableDirectory(settings.RepositoriesLocation, false)
+		}},
+		{"lfs", func(context.Context) error {
+			return checkWritableDirectory(settings.LFS.StoragePath, true)
+		}},
+		{"webhooks", func(context.Context) error {
+			return checkWritableDirectory(settings.Webhooks.QueuePath, true)
+		}},
+	}
+}
+
+// Check path is a directory files can be created in. Directories created on
+// first use are created when missing if create is set.
+func checkWritableDirectory(path string, create bool) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		err = os.MkdirAll(path, 0750)
+		if err != nil {
+			return err
+		}
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	probe, err := os.CreateTemp(path, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+
+	return os.Remove(probe.Name())
+}
+
+// The process is up and serving requests
+func HealthzHandler(writer http.ResponseWriter, request *http.Request) error {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := writer.Write([]byte("ok\n"))
+	return err
+}
+
+// Why a check failed is only logged, /readyz is anonymous and errors give
+// away paths and versions
+type checkResult struct {
+	Status string `json:"status"`
+}
+
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// Run checks at once, each failing when it doesn't finish before ctx is done.
+// Failures are logged.
+func runReadinessChecks(ctx context.Context, checks []readinessCheck) (map[string]checkResult, bool) {
+	results := map[string]checkResult{}
+	ready := true
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- check.check(ctx)
+			}()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = fmt.Errorf("timed out after %s", readinessTimeout)
+			}
+
+			result := checkResult{Status: "ok"}
+			if err != nil {
+				slog.WarnContext(ctx, "readiness check failed", "check", check.name, "error", err)
+				result.Status = "failing"
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[check.name] = result
+			if result.Status != "ok" {
+				ready = false
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results, ready
+}
+
+// The server is ready for traffic: git is usable and the storage reachable.
+// Fails with 503 once a shutdown starts or when any check does.
+func ReadyzHandler(writer http.ResponseWriter, request *http.Request) error {
+	result := readiness{Status: "ready"}
+	status := http.StatusOK
+
+	if shuttingDown.Load() {
+		result.Status = "shutting down"
+		status = http.StatusServiceUnavailable
+	} else {
+		ctx, cancel := context.WithTimeout(request.Context(), readinessTimeout)
+		defer cancel()
+
+		var ready bool
+		result.Checks, ready = runReadinessChecks(ctx, readinessChecks(config.Settings))
+		if !ready {
+			result.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	return json.NewEncoder(writer).Encode(result)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/lfs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Handlers for the Git LFS batch, basic transfer and locking APIs, see
+// https://github.com/git-lfs/git-lfs/tree/main/docs/api. Objects are uploaded
+// and downloaded through the same repository URL and credentials as the git
+// endpoints.
+
+const lfsContentType = "application/vnd.git-lfs+json"
+
+// Locks returned by a single list or verify request unless the client asks
+// for fewer
+const maxLocksPerPage = 100
+
+type lfsHandlers struct {
+	store *lfs.Store
+}
+
+type lfsObject struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError      `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+	HashAlgo string      `json:"hash_algo"`
+}
+
+func writeLFSJSON(writer http.ResponseWriter, status int, body any) error {
+	writer.Header().Set("Content-Type", lfsContentType)
+	writer.WriteHeader(status)
+	return json.NewEncoder(writer).Encode(body)
+}
+
+func writeLFSError(writer http.ResponseWriter, status int, message string) error {
+	return writeLFSJSON(writer, status, map[string]string{"message": message})
+}
+
+func (h lfsHandlers) BatchHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	var batch lfsBatchRequest
+	err = json.NewDecoder(request.Body).Decode(&batch)
+	if err != nil {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, "invalid batch request")
+	}
+
+	if batch.HashAlgo != "" && batch.HashAlgo != "sha256" {
+		return writeLFSError(writer, http.StatusConflict, fmt.Sprintf("unsupported hash algorithm %s", batch.HashAlgo))
+	}
+
+	if len(batch.Transfers) > 0 && !slices.Contains(batch.Transfers, "basic") {
+		return writeLFSError(writer, http.StatusConflict, "only the basic transfer adapter is supported")
+	}
+
+	switch batch.Operation {
+	case "download":
+	case "upload":
+		if auth.AccessLevelFromContext(request.Context()) < auth.WriteAccess {
+			user, _ := auth.UserFromContext(request.Context())
+			return writeLFSError(writer, http.StatusForbidden, fmt.Sprintf("Permission to %s/%s denied to %s.", remoteRepo.OrgName, remoteRepo.Name, user.Name))
+		}
+	default:
+		return writeLFSError(writer, http.StatusUnprocessableEntity, fmt.Sprintf("unknown operation %q", batch.Operation))
+	}
+
+	// Follow-up requests go to the same server, pass the credentials along
+	header := map[string]string{}
+	if authorization := request.Header.Get("Authorization"); authorization != "" {
+		header["Authorization"] = authorization
+	}
+
+	objectsURL := remoteRepo.CloneURL + "/info/lfs/objects/"
+
+	response := lfsBatchResponse{Transfer: "basic", Objects: []lfsObject{}, HashAlgo: "sha256"}
+	for _, object := range batch.Objects {
+		result := lfsObject{OID: object.OID, Size: object.Size}
+
+		if !lfs.ValidOID(object.OID) || object.Size < 0 {
+			result.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "invalid object"}
+			response.Objects = append(response.Objects, result)
+			continue
+		}
+
+		size, exists, err := h.store.Stat(remoteRepo, object.OID)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case batch.Operation == "download" && (!exists || size != object.Size):
+			result.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "object does not exist"}
+		case batch.Operation == "download":
+			result.Authenticated = true
+			result.Actions = map[string]lfsAction{
+				"download": {Href: objectsURL + object.OID, Header: header},
+			}
+		case !exists:
+			result.Authenticated = true
+			result.Actions = map[string]lfsAction{
+				"upload": {Href: objectsURL + object.OID, Header: header},
+				"verify": {Href: objectsURL + "verify", Header: header},
+			}
+		}
+		// Objects the server already has need no actions for an upload
+
+		response.Objects = append(response.Objects, result)
+	}
+
+	return writeLFSJSON(writer, http.StatusOK, response)
+}
+
+func (h lfsHandlers) UploadHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	err = h.store.Put(remoteRepo, request.PathValue("oid"), request.Body)
+	if errors.Is(err, lfs.ErrInvalidOID) || errors.Is(err, lfs.ErrHashMismatch) {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, err.Error())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h lfsHandlers) DownloadHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	object, err := h.store.Open(remoteRepo, request.PathValue("oid"))
+	if errors.Is(err, lfs.ErrInvalidOID) || errors.Is(err, os.ErrNotExist) {
+		return writeLFSError(writer, http.StatusNotFound, "object does not exist")
+	}
+
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Objects never change once stored
+	cacheControl, err := immutableCacheControl(request.Context(), remoteRepo)
+	if err != nil {
+		return err
+	}
+
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(writer, request, "", info.ModTime(), object)
+	return nil
+}
+
+func (h lfsHandlers) VerifyHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	var object lfsObject
+	err = json.NewDecoder(request.Body).Decode(&object)
+	if err != nil || !lfs.ValidOID(object.OID) {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, "invalid verify request")
+	}
+
+	size, exists, err := h.store.Stat(remoteRepo, object.OID)
+	if err != nil {
+		return err
+	}
+
+	if !exists || size != object.Size {
+		return writeLFSError(writer, http.StatusNotFound, "object does not exist")
+	}
+
+	return writeLFSJSON(writer, http.StatusOK, map[string]string{})
+}
+
+func (h lfsHandlers) CreateLockHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Path string `json:"path"`
+	}
+	err = json.NewDecoder(request.Body).Decode(&body)
+	if err != nil || body.Path == "" {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, "invalid lock request")
+	}
+
+	user, _ := auth.UserFromContext(request.Context())
+	lock, err := h.store.CreateLock(remoteRepo, body.Path, user.Name)
+	if errors.Is(err, lfs.ErrLockExists) {
+		return writeLFSJSON(writer, http.StatusConflict, map[string]any{"lock": lock, "message": "already created lock"})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeLFSJSON(writer, http.StatusCreated, map[string]any{"lock": lock})
+}
+
+func (h lfsHandlers) ListLocksHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	locks, err := h.store.Locks(remoteRepo)
+	if err != nil {
+		return err
+	}
+
+	query := request.URL.Query()
+	locks = slices.DeleteFunc(locks, func(l lfs.Lock) bool {
+		return (query.Has("path") && l.Path != query.Get("path")) || (query.Has("id") && l.ID != query.Get("id"))
+	})
+
+	page, nextCursor, err := paginateLocks(locks, query.Get("cursor"), query.Get("limit"))
+	if err != nil {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, err.Error())
+	}
+
+	return writeLFSJSON(writer, http.StatusOK, map[string]any{"locks": page, "next_cursor": nextCursor})
+}
+
+func (h lfsHandlers) VerifyLocksHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Cursor string `json:"cursor"`
+		Limit  int    `json:"limit"`
+	}
+	err = json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, "invalid lock verify request")
+	}
+
+	locks, err := h.store.Locks(remoteRepo)
+	if err != nil {
+		return err
+	}
+
+	limit := ""
+	if body.Limit > 0 {
+		limit = strconv.Itoa(body.Limit)
+	}
+
+	page, nextCursor, err := paginateLocks(locks, body.Cursor, limit)
+	if err != nil {
+		return writeLFSError(writer, http.StatusUnprocessableEntity, err.Error())
+	}
+
+	// Pushes are checked against the locks of everybody else
+	user, _ := auth.UserFromContext(request.Context())
+	ours, theirs := []lfs.Lock{}, []lfs.Lock{}
+	for _, lock := range page {
+		if lock.Owner.Name == user.Name {
+			ours = append(ours, lock)
+		} else {
+			theirs = append(theirs, lock)
+		}
+	}
+
+	return writeLFSJSON(writer, http.StatusOK, map[string]any{"ours": ours, "theirs": theirs, "next_cursor": nextCursor})
+}
+
+func (h lfsHandlers) UnlockHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Force bool `json:"force"`
+	}
+	// The body is optional, no body means no force
+	json.NewDecoder(request.Body).Decode(&body)
+
+	// Breaking somebody else's lock takes an admin
+	if body.Force && auth.AccessLevelFromContext(request.Context()) < auth.AdminAccess {
+		return writeLFSError(writer, http.StatusForbidden, "forcing an unlock needs admin access")
+	}
+
+	user, _ := auth.UserFromContext(request.Context())
+	lock, err := h.store.Unlock(remoteRepo, request.PathValue("id"), user.Name, body.Force)
+	if errors.Is(err, lfs.ErrLockNotFound) {
+		return writeLFSError(writer, http.StatusNotFound, err.Error())
+	}
+
+	if errors.Is(err, lfs.ErrNotLockOwner) {
+		return writeLFSError(writer, http.StatusForbidden, fmt.Sprintf("lock is owned by %s", lock.Owner.Name))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeLFSJSON(writer, http.StatusOK, map[string]any{"lock": lock})
+}
+
+// Return the page of locks starting at cursor, an offset into locks, and the
+// cursor of the next page or an empty one on the last page
+func paginateLocks(locks []lfs.Lock, cursor, limit string) ([]lfs.Lock, string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		start, err = strconv.Atoi(cursor)
+		if err != nil || start < 0 || start > len(locks) {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+	}
+
+	pageSize := maxLocksPerPage
+	if limit != "" {
+		var err error
+		pageSize, err = strconv.Atoi(limit)
+		if err != nil || pageSize <= 0 {
+			return nil, "", fmt.Errorf("invalid limit %q", limit)
+		}
+		pageSize = min(pageSize, maxLocksPerPage)
+	}
+
+	end := min(start+pageSize, len(locks))
+	if end == len(locks) {
+		return locks[start:end], "", nil
+	}
+
+	return locks[start:end], strconv.Itoa(end), nil
+}
@@ -0,0 +1,113 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gitgud/atomicfile"
+	"gitgud/git"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// Git LFS objects are content addressed by their SHA-256
+var oidPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func ValidOID(oid string) bool {
+	return oidPattern.MatchString(oid)
+}
+
+var (
+	ErrInvalidOID   = errors.New("invalid object id")
+	ErrHashMismatch = errors.New("object contents do not match the object id")
+	ErrLockExists   = errors.New("path is already locked")
+	ErrLockNotFound = errors.New("lock not found")
+	ErrNotLockOwner = errors.New("lock is owned by another user")
+)
+
+// Objects and locks of every repository, stored below Path in the same
+// org/repo.git layout as the repositories themselves, e.g.
+//
+//	lfs/org/repo.git/objects/ab/cd/abcd...
+//	lfs/org/repo.git/locks.json
+type Store struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+func (s *Store) repositoryPath(remoteRepo git.GitRemoteRepository) string {
+	return filepath.Join(s.Path, remoteRepo.OrgName, remoteRepo.FullName)
+}
+
+func (s *Store) objectPath(remoteRepo git.GitRemoteRepository, oid string) string {
+	return filepath.Join(s.repositoryPath(remoteRepo), "objects", oid[0:2], oid[2:4], oid)
+}
+
+// Return the size of the object, false when the repository doesn't have it.
+func (s *Store) Stat(remoteRepo git.GitRemoteRepository, oid string) (int64, bool, error) {
+	if !ValidOID(oid) {
+		return 0, false, ErrInvalidOID
+	}
+
+	info, err := os.Stat(s.objectPath(remoteRepo, oid))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to stat lfs object: %w", err)
+	}
+
+	return info.Size(), true, nil
+}
+
+func (s *Store) Open(remoteRepo git.GitRemoteRepository, oid string) (*os.File, error) {
+	if !ValidOID(oid) {
+		return nil, ErrInvalidOID
+	}
+
+	return os.Open(s.objectPath(remoteRepo, oid))
+}
+
+// Store the object read from contents. Nothing is stored unless the contents
+// hash to oid, so a failed upload never leaves a corrupt object behind.
+func (s *Store) Put(remoteRepo git.GitRemoteRepository, oid string, contents io.Reader) error {
+	if !ValidOID(oid) {
+		return ErrInvalidOID
+	}
+
+	objectPath := s.objectPath(remoteRepo, oid)
+	err := os.MkdirAll(filepath.Dir(objectPath), 0750)
+	if err != nil {
+		return fmt.Errorf("failed to create lfs object directory: %w", err)
+	}
+
+	// Objects only show up once their contents were checked against oid
+	err = atomicfile.Write(objectPath, func(writer io.Writer) error {
+		hash := sha256.New()
+		_, err := io.Copy(io.MultiWriter(writer, hash), contents)
+		if err != nil {
+			return err
+		}
+
+		if hex.EncodeToString(hash.Sum(nil)) != oid {
+			return ErrHashMismatch
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrHashMismatch) {
+		return fmt.Errorf("failed to store lfs object: %w", err)
+	}
+
+	return err
+}
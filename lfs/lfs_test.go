@@ -0,0 +1,100 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"gitgud/git"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T) (*Store, git.GitRemoteRepository) {
+	t.Helper()
+
+	remoteRepo, err := git.NewRemoteRepository("", "test_org", "test_repo_lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewStore(t.TempDir()), remoteRepo
+}
+
+func TestStore_Put(t *testing.T) {
+	store, remoteRepo := newTestStore(t)
+
+	contents := "large binary asset"
+	sum := sha256.Sum256([]byte(contents))
+	oid := hex.EncodeToString(sum[:])
+
+	err := store.Put(remoteRepo, strings.Repeat("a", 64), strings.NewReader(contents))
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Put() with the wrong oid = %v, want ErrHashMismatch", err)
+	}
+
+	err = store.Put(remoteRepo, "../../escape", strings.NewReader(contents))
+	if !errors.Is(err, ErrInvalidOID) {
+		t.Errorf("Put() with an invalid oid = %v, want ErrInvalidOID", err)
+	}
+
+	_, exists, err := store.Stat(remoteRepo, strings.Repeat("a", 64))
+	if err != nil || exists {
+		t.Errorf("Stat() after a mismatched upload = %v, %v, want nothing stored", exists, err)
+	}
+
+	err = store.Put(remoteRepo, oid, strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, exists, err := store.Stat(remoteRepo, oid)
+	if err != nil || !exists || size != int64(len(contents)) {
+		t.Errorf("Stat() = %d, %v, %v, want %d, true, nil", size, exists, err, len(contents))
+	}
+
+	object, err := store.Open(remoteRepo, oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+
+	got, err := io.ReadAll(object)
+	if err != nil || string(got) != contents {
+		t.Errorf("Open() read %q, %v, want %q", got, err, contents)
+	}
+}
+
+func TestStore_Locks(t *testing.T) {
+	store, remoteRepo := newTestStore(t)
+
+	lock, err := store.CreateLock(remoteRepo, "assets/logo.psd", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing, err := store.CreateLock(remoteRepo, "assets/logo.psd", "bob")
+	if !errors.Is(err, ErrLockExists) || existing.ID != lock.ID {
+		t.Errorf("CreateLock() on a locked path = %+v, %v, want the existing lock and ErrLockExists", existing, err)
+	}
+
+	_, err = store.Unlock(remoteRepo, lock.ID, "bob", false)
+	if !errors.Is(err, ErrNotLockOwner) {
+		t.Errorf("Unlock() by another user = %v, want ErrNotLockOwner", err)
+	}
+
+	_, err = store.Unlock(remoteRepo, "missing", "alice", false)
+	if !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Unlock() of a missing lock = %v, want ErrLockNotFound", err)
+	}
+
+	_, err = store.Unlock(remoteRepo, lock.ID, "bob", true)
+	if err != nil {
+		t.Errorf("forced Unlock() = %v", err)
+	}
+
+	locks, err := store.Locks(remoteRepo)
+	if err != nil || len(locks) != 0 {
+		t.Errorf("Locks() = %+v, %v, want none left", locks, err)
+	}
+}
@@ -0,0 +1,138 @@
+package lfs
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitgud/atomicfile"
+	"gitgud/git"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// File lock in the shape of the Git LFS locking API
+type Lock struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	LockedAt time.Time `json:"locked_at"`
+	Owner    Owner     `json:"owner"`
+}
+
+type Owner struct {
+	Name string `json:"name"`
+}
+
+func (s *Store) locksPath(remoteRepo git.GitRemoteRepository) string {
+	return filepath.Join(s.repositoryPath(remoteRepo), "locks.json")
+}
+
+func (s *Store) loadLocks(remoteRepo git.GitRemoteRepository) ([]Lock, error) {
+	contents, err := os.ReadFile(s.locksPath(remoteRepo))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Lock{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lfs locks: %w", err)
+	}
+
+	locks := []Lock{}
+	err = json.Unmarshal(contents, &locks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lfs locks: %w", err)
+	}
+
+	return locks, nil
+}
+
+func (s *Store) saveLocks(remoteRepo git.GitRemoteRepository, locks []Lock) error {
+	contents, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lfs locks: %w", err)
+	}
+
+	locksPath := s.locksPath(remoteRepo)
+	err = os.MkdirAll(filepath.Dir(locksPath), 0750)
+	if err != nil {
+		return fmt.Errorf("failed to create lfs lock directory: %w", err)
+	}
+
+	err = atomicfile.WriteFile(locksPath, contents)
+	if err != nil {
+		return fmt.Errorf("failed to save lfs locks: %w", err)
+	}
+
+	return nil
+}
+
+// Return the locks of the repository, oldest first
+func (s *Store) Locks(remoteRepo git.GitRemoteRepository) ([]Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loadLocks(remoteRepo)
+}
+
+// Lock path for owner. When the path is already locked the existing lock is
+// returned along with ErrLockExists.
+func (s *Store) CreateLock(remoteRepo git.GitRemoteRepository, path, owner string) (Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locks, err := s.loadLocks(remoteRepo)
+	if err != nil {
+		return Lock{}, err
+	}
+
+	index := slices.IndexFunc(locks, func(l Lock) bool { return l.Path == path })
+	if index >= 0 {
+		return locks[index], ErrLockExists
+	}
+
+	lock := Lock{
+		ID:       strings.ToLower(rand.Text()),
+		Path:     path,
+		LockedAt: time.Now().UTC(),
+		Owner:    Owner{Name: owner},
+	}
+
+	err = s.saveLocks(remoteRepo, append(locks, lock))
+	if err != nil {
+		return Lock{}, err
+	}
+
+	return lock, nil
+}
+
+// Remove the lock with id on behalf of user, only its owner may unless force
+// is set.
+func (s *Store) Unlock(remoteRepo git.GitRemoteRepository, id, user string, force bool) (Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locks, err := s.loadLocks(remoteRepo)
+	if err != nil {
+		return Lock{}, err
+	}
+
+	index := slices.IndexFunc(locks, func(l Lock) bool { return l.ID == id })
+	if index < 0 {
+		return Lock{}, ErrLockNotFound
+	}
+
+	lock := locks[index]
+	if lock.Owner.Name != user && !force {
+		return lock, ErrNotLockOwner
+	}
+
+	err = s.saveLocks(remoteRepo, slices.Delete(locks, index, index+1))
+	if err != nil {
+		return Lock{}, err
+	}
+
+	return lock, nil
+}
@@ -0,0 +1,398 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitgud/config"
+	"gitgud/git"
+	"gitgud/metrics"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Returned when the queue of a limiter is full or a request waited in it for
+// longer than the queue timeout
+var ErrBusy = errors.New("server busy")
+
+// Snapshot of a limiter for monitoring
+type Stats struct {
+	// Zero when there is no limit, per key for a KeyedLimiter
+	Limit int
+
+	Running  int
+	Queued   int
+	Acquired int
+	Rejected int
+
+	// Time spent waiting in the queue by every acquired or rejected request
+	WaitSeconds float64
+}
+
+// Counters shared by the limiters of every repository
+type counters struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Limiter lets at most a fixed number of holders run at once. Others wait in
+// a bounded queue, and are turned away with ErrBusy when it is full or they
+// have waited for too long.
+type Limiter struct {
+	// Holds a value for every running holder, nil when there is no limit
+	slots chan struct{}
+
+	queueLength  int
+	queueTimeout time.Duration
+
+	// Requests waiting for this limiter, the counters can be shared with
+	// other limiters
+	queued int
+
+	counters *counters
+}
+
+func NewLimiter(limit, queueLength int, queueTimeout time.Duration) *Limiter {
+	return newLimiter(limit, queueLength, queueTimeout, &counters{stats: Stats{Limit: limit}})
+}
+
+func newLimiter(limit, queueLength int, queueTimeout time.Duration, counters *counters) *Limiter {
+	limiter := &Limiter{
+		queueLength:  queueLength,
+		queueTimeout: queueTimeout,
+		counters:     counters,
+	}
+
+	if limit > 0 {
+		limiter.slots = make(chan struct{}, limit)
+	}
+
+	return limiter
+}
+
+// Wait for a slot, returning the function giving it back and how long the
+// wait took. Waiting stops with the error of ctx once it is done.
+func (l *Limiter) Acquire(ctx context.Context) (func(), time.Duration, error) {
+	start := time.Now()
+
+	if l.slots == nil {
+		return l.acquired(start), 0, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.acquired(start), 0, nil
+	default:
+	}
+
+	l.counters.mu.Lock()
+	if l.queued >= l.queueLength {
+		l.counters.stats.Rejected++
+		l.counters.mu.Unlock()
+		return nil, 0, ErrBusy
+	}
+	l.queued++
+	l.counters.stats.Queued++
+	l.counters.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case l.slots <- struct{}{}:
+	case <-timeout:
+		err = ErrBusy
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	}
+
+	waited := time.Since(start)
+
+	l.counters.mu.Lock()
+	defer l.counters.mu.Unlock()
+	l.queued--
+	l.counters.stats.Queued--
+	l.counters.stats.WaitSeconds += waited.Seconds()
+
+	if err != nil {
+		if errors.Is(err, ErrBusy) {
+			l.counters.stats.Rejected++
+		}
+		return nil, waited, err
+	}
+
+	l.counters.stats.Acquired++
+	l.counters.stats.Running++
+	return l.release, waited, nil
+}
+
+func (l *Limiter) acquired(start time.Time) func() {
+	l.counters.mu.Lock()
+	defer l.counters.mu.Unlock()
+
+	l.counters.stats.Acquired++
+	l.counters.stats.Running++
+	l.counters.stats.WaitSeconds += time.Since(start).Seconds()
+
+	return l.release
+}
+
+func (l *Limiter) release() {
+	l.counters.mu.Lock()
+	l.counters.stats.Running--
+	l.counters.mu.Unlock()
+
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *Limiter) Stats() Stats {
+	l.counters.mu.Lock()
+	defer l.counters.mu.Unlock()
+
+	return l.counters.stats
+}
+
+// Limiters letting one holder at a time run for each key, created when a key
+// is first used and dropped once nobody holds or waits for it
+type KeyedLimiter struct {
+	queueLength  int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	limiters map[string]*keyedEntry
+
+	counters *counters
+}
+
+type keyedEntry struct {
+	limiter *Limiter
+
+	// Holders and waiters of the limiter
+	users int
+}
+
+func NewKeyedLimiter(queueLength int, queueTimeout time.Duration) *KeyedLimiter {
+	return &KeyedLimiter{
+		queueLength:  queueLength,
+		queueTimeout: queueTimeout,
+		limiters:     map[string]*keyedEntry{},
+		counters:     &counters{stats: Stats{Limit: 1}},
+	}
+}
+
+// Wait for the slot of key, see Limiter.Acquire
+func (k *KeyedLimiter) Acquire(ctx context.Context, key string) (func(), time.Duration, error) {
+	k.mu.Lock()
+	entry, ok := k.limiters[key]
+	if !ok {
+		entry = &keyedEntry{limiter: newLimiter(1, k.queueLength, k.queueTimeout, k.counters)}
+		k.limiters[key] = entry
+	}
+	entry.users++
+	k.mu.Unlock()
+
+	done := func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+
+		entry.users--
+		if entry.users == 0 {
+			delete(k.limiters, key)
+		}
+	}
+
+	release, waited, err := entry.limiter.Acquire(ctx)
+	if err != nil {
+		done()
+		return nil, waited, err
+	}
+
+	return func() {
+		release()
+		done()
+	}, waited, nil
+}
+
+// Counters summed over every key
+func (k *KeyedLimiter) Stats() Stats {
+	k.counters.mu.Lock()
+	defer k.counters.mu.Unlock()
+
+	return k.counters.stats
+}
+
+// Limits on the git services run for clients: a global limit for each
+// service and pushes to the same repository one at a time.
+type Services struct {
+	Settings config.LimitSettings
+
+	uploadPack   *Limiter
+	receivePack  *Limiter
+	repositories *KeyedLimiter
+
+	mu sync.Mutex
+
+	// Services running for each org/repo
+	busy map[string]int
+
+	// Closed and replaced whenever a service is done
+	done chan struct{}
+}
+
+func NewServices(settings config.LimitSettings) *Services {
+	return &Services{
+		Settings:     settings,
+		uploadPack:   NewLimiter(settings.UploadPack, settings.QueueLength, settings.QueueTimeout),
+		receivePack:  NewLimiter(settings.ReceivePack, settings.QueueLength, settings.QueueTimeout),
+		repositories: NewKeyedLimiter(settings.QueueLength, settings.QueueTimeout),
+		busy:         map[string]int{},
+		done:         make(chan struct{}),
+	}
+}
+
+var defaultServices = sync.OnceValue(func() *Services {
+	return NewServices(config.Settings.Limits)
+})
+
+func init() {
+	// Scraped from /metrics
+	collect := func(value func(Stats) float64) func(emit func(float64, ...string)) {
+		return func(emit func(float64, ...string)) {
+			stats := DefaultServices().Stats()
+			for _, limiter := range slices.Sorted(maps.Keys(stats)) {
+				emit(value(stats[limiter]), limiter)
+			}
+		}
+	}
+
+	labels := []string{"limiter"}
+	metrics.Default.GaugeFunc("gitgud_git_services_running", "Git services holding a slot, by limiter.", labels,
+		collect(func(s Stats) float64 { return float64(s.Running) }))
+	metrics.Default.GaugeFunc("gitgud_git_services_queued", "Git services waiting for a slot, by limiter.", labels,
+		collect(func(s Stats) float64 { return float64(s.Queued) }))
+	metrics.Default.CounterFunc("gitgud_git_services_acquired_total", "Git services given a slot, by limiter.", labels,
+		collect(func(s Stats) float64 { return float64(s.Acquired) }))
+	metrics.Default.CounterFunc("gitgud_git_services_rejected_total", "Git services turned away by a full queue or the queue timeout, by limiter.", labels,
+		collect(func(s Stats) float64 { return float64(s.Rejected) }))
+	metrics.Default.CounterFunc("gitgud_git_services_wait_seconds_total", "Time git services spent queued for a slot, by limiter.", labels,
+		collect(func(s Stats) float64 { return s.WaitSeconds }))
+}
+
+// Limits shared by every listener running git services
+func DefaultServices() *Services {
+	return defaultServices()
+}
+
+// Wait until service may run for remoteRepo, returning the function to call
+// once it is done. Pushes first wait for their repository so they don't hold
+// a global slot while queued behind another push.
+func (s *Services) Acquire(ctx context.Context, service string, remoteRepo git.GitRemoteRepository) (func(), error) {
+	var release func()
+	var waited time.Duration
+	var err error
+
+	switch service {
+	case "git-upload-pack":
+		release, waited, err = s.uploadPack.Acquire(ctx)
+	case "git-receive-pack":
+		var releaseRepository func()
+		releaseRepository, waited, err = s.repositories.Acquire(ctx, remoteRepo.FullPath)
+		if err != nil {
+			break
+		}
+
+		var releaseService func()
+		var wait time.Duration
+		releaseService, wait, err = s.receivePack.Acquire(ctx)
+		waited += wait
+		if err != nil {
+			releaseRepository()
+			break
+		}
+
+		release = func() {
+			releaseService()
+			releaseRepository()
+		}
+	default:
+		return nil, fmt.Errorf("unknown service: %s", service)
+	}
+
+	if waited > 0 {
+		slog.InfoContext(ctx, "service queued", "service", service, "org", remoteRepo.OrgName, "repository", remoteRepo.Name, "wait", waited, "error", err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	repository := remoteRepo.OrgName + "/" + remoteRepo.Name
+
+	s.mu.Lock()
+	s.busy[repository]++
+	s.mu.Unlock()
+
+	return func() {
+		release()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.busy[repository]--
+		if s.busy[repository] == 0 {
+			delete(s.busy, repository)
+		}
+
+		close(s.done)
+		s.done = make(chan struct{})
+	}, nil
+}
+
+// Number of services running for each org/repo
+func (s *Services) Busy() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.busy)
+}
+
+// Wait until no service is running, or return the error of ctx once it is
+// done
+func (s *Services) Wait(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		idle := len(s.busy) == 0
+		done := s.done
+		s.mu.Unlock()
+
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stats of the global limits by service, and of the pushes queued for their
+// repository
+func (s *Services) Stats() map[string]Stats {
+	return map[string]Stats{
+		"git-upload-pack":  s.uploadPack.Stats(),
+		"git-receive-pack": s.receivePack.Stats(),
+		"repositories":     s.repositories.Stats(),
+	}
+}
@@ -0,0 +1,158 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"gitgud/config"
+	"gitgud/git"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(1, 1, time.Minute)
+
+	release, _, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, _, err := limiter.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	// Wait for the second request to be queued
+	for limiter.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, _, err = limiter.Acquire(context.Background())
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("Acquire() with a full queue error = %v, want ErrBusy", err)
+	}
+
+	release()
+	(<-acquired)()
+
+	want := Stats{Limit: 1, Acquired: 2, Rejected: 1}
+	got := limiter.Stats()
+	got.WaitSeconds = 0
+	if got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	limiter := NewLimiter(1, 1, 10*time.Millisecond)
+
+	release, _, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	_, waited, err := limiter.Acquire(context.Background())
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("Acquire() error = %v, want ErrBusy", err)
+	}
+
+	if waited < 10*time.Millisecond {
+		t.Errorf("Acquire() waited %s, want at least the queue timeout", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err = limiter.Acquire(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire() with a cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := NewKeyedLimiter(0, time.Minute)
+
+	releaseFirst, _, err := limiter.Acquire(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseSecond, _, err := limiter.Acquire(context.Background(), "second")
+	if err != nil {
+		t.Fatalf("Acquire() of another key error = %v", err)
+	}
+
+	_, _, err = limiter.Acquire(context.Background(), "first")
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("Acquire() of a held key error = %v, want ErrBusy", err)
+	}
+
+	if got := limiter.Stats().Running; got != 2 {
+		t.Errorf("Stats().Running = %d, want 2", got)
+	}
+
+	releaseFirst()
+	releaseSecond()
+
+	if len(limiter.limiters) != 0 {
+		t.Errorf("%d limiters left after every key was released", len(limiter.limiters))
+	}
+}
+
+func TestServices_Acquire(t *testing.T) {
+	services := NewServices(config.LimitSettings{
+		UploadPack:   1,
+		ReceivePack:  2,
+		QueueLength:  0,
+		QueueTimeout: time.Minute,
+	})
+
+	repo, err := git.NewRemoteRepository("http://localhost", "test_org", "test_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherRepo, err := git.NewRemoteRepository("http://localhost", "test_org", "other_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releasePush, err := services.Acquire(context.Background(), "git-receive-pack", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releasePush()
+
+	_, err = services.Acquire(context.Background(), "git-receive-pack", repo)
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("second push to a repository error = %v, want ErrBusy", err)
+	}
+
+	releaseOther, err := services.Acquire(context.Background(), "git-receive-pack", otherRepo)
+	if err != nil {
+		t.Errorf("push to another repository error = %v", err)
+	} else {
+		releaseOther()
+	}
+
+	releaseFetch, err := services.Acquire(context.Background(), "git-upload-pack", repo)
+	if err != nil {
+		t.Fatalf("fetch during a push error = %v", err)
+	}
+	defer releaseFetch()
+
+	_, err = services.Acquire(context.Background(), "git-upload-pack", otherRepo)
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("fetch over the limit error = %v, want ErrBusy", err)
+	}
+
+	stats := services.Stats()
+	if stats["git-receive-pack"].Running != 1 || stats["git-upload-pack"].Rejected != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
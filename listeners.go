@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gitgud/config"
+	"gitgud/metrics"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// HTTP server and one of the listeners it serves
+type httpListener struct {
+	server   *http.Server
+	listener net.Listener
+	tls      bool
+}
+
+func (l httpListener) serve() error {
+	if l.tls {
+		return l.server.ServeTLS(l.listener, "", "")
+	}
+
+	return l.server.Serve(l.listener)
+}
+
+// Open every listener configured in settings. HTTPS gets a server of its
+// own, ServeTLS sets up HTTP/2 on the server it is called on and mustn't
+// race a Serve of the same server. Plain HTTP and the Unix socket share one,
+// except that plain HTTP redirects to HTTPS when asked to.
+func openHTTPListeners(settings config.ServerSettings, handler http.Handler, baseContext context.Context) ([]httpListener, error) {
+	newServer := func() *http.Server {
+		server := &http.Server{
+			Handler:     handler,
+			BaseContext: func(net.Listener) context.Context { return baseContext },
+			Protocols:   new(http.Protocols),
+		}
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(settings.HTTP2)
+		return server
+	}
+	server := newServer()
+
+	listeners := []httpListener{}
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.listener.Close()
+		}
+	}
+
+	tlsEnabled := settings.TLS.CertPath != ""
+	var httpsPort string
+	if tlsEnabled {
+		certificates, err := newCertificateLoader(settings.TLS.CertPath, settings.TLS.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsServer := newServer()
+		tlsServer.TLSConfig = &tls.Config{GetCertificate: certificates.GetCertificate}
+
+		listener, err := net.Listen("tcp", settings.TLS.Address)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, httpListener{server: tlsServer, listener: listener, tls: true})
+
+		_, httpsPort, _ = net.SplitHostPort(listener.Addr().String())
+	}
+
+	if settings.Address != "" {
+		listener, err := net.Listen("tcp", settings.Address)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		if tlsEnabled && settings.RedirectHTTP {
+			redirect := &http.Server{Handler: redirectToHTTPS(httpsPort)}
+			listeners = append(listeners, httpListener{server: redirect, listener: listener})
+		} else {
+			listeners = append(listeners, httpListener{server: server, listener: listener})
+		}
+	}
+
+	if settings.SocketPath != "" {
+		listener, err := listenUnix(settings.SocketPath)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, httpListener{server: server, listener: listener})
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no HTTP listener configured")
+	}
+
+	return listeners, nil
+}
+
+// Open the listener serving /metrics on address, kept apart from the
+// listeners clients use
+func openMetricsListener(address string, baseContext context.Context) (httpListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return httpListener{}, err
+	}
+
+	router := http.NewServeMux()
+	router.Handle("GET /metrics", metrics.Default.Handler())
+
+	server := &http.Server{
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return baseContext },
+	}
+
+	return httpListener{server: server, listener: listener}, nil
+}
+
+// Listen on a Unix socket at path, replacing the socket left behind by a
+// previous run. The socket is removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&fs.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Redirect every request to the same URL over HTTPS on httpsPort. The 308
+// keeps the method and body of pushes.
+func redirectToHTTPS(httpsPort string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host
+		}
+
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: request.URL.Path, RawQuery: request.URL.RawQuery}
+		http.Redirect(writer, request, target.String(), http.StatusPermanentRedirect)
+	}
+}
+
+// Serves the certificate and key at certPath and keyPath, loading them again
+// once either file changes. A pair that fails to load is logged and the
+// previous one kept, so a renewal written one file at a time does no harm.
+type certificateLoader struct {
+	certPath string
+	keyPath  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertificateLoader(certPath, keyPath string) (*certificateLoader, error) {
+	loader := &certificateLoader{certPath: certPath, keyPath: keyPath}
+
+	err := loader.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return loader, nil
+}
+
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	err := l.reload()
+	if err != nil {
+		slog.Error("failed to reload TLS certificate", "cert", l.certPath, "key", l.keyPath, "error", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.certificate, nil
+}
+
+// Load the pair unless it is unchanged since it was last loaded
+func (l *certificateLoader) reload() error {
+	certInfo, err := os.Stat(l.certPath)
+	if err != nil {
+		return err
+	}
+
+	keyInfo, err := os.Stat(l.keyPath)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.certificate != nil && certInfo.ModTime().Equal(l.certModTime) && keyInfo.ModTime().Equal(l.keyModTime) {
+		return nil
+	}
+
+	// A broken pair isn't tried again until one of the files changes
+	l.certModTime = certInfo.ModTime()
+	l.keyModTime = keyInfo.ModTime()
+
+	certificate, err := tls.LoadX509KeyPair(l.certPath, l.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	if l.certificate != nil {
+		slog.Info("TLS certificate reloaded", "cert", l.certPath)
+	}
+
+	l.certificate = &certificate
+	return nil
+}
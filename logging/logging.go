@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type attrsKey struct{}
+
+// Return a copy of ctx whose records get attrs added when logged through a
+// Handler, on top of those already carried by ctx
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	combined := append(existing[:len(existing):len(existing)], attrs...)
+	return context.WithValue(ctx, attrsKey{}, combined)
+}
+
+// Attributes carried by ctx
+func Attrs(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// Logger adding the attributes of ctx to records logged without a context,
+// for code that doesn't pass one along
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	for _, attr := range Attrs(ctx) {
+		logger = logger.With(attr)
+	}
+
+	return logger
+}
+
+// Handler adding the attributes carried by the context of each record, so
+// slog.InfoContext(ctx, ...) and the like log what ctx was given with
+// WithAttrs.
+type Handler struct {
+	slog.Handler
+}
+
+func NewHandler(handler slog.Handler) *Handler {
+	return &Handler{Handler: handler}
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	record.AddAttrs(Attrs(ctx)...)
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewHandler(h.Handler.WithAttrs(attrs))
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return NewHandler(h.Handler.WithGroup(name))
+}
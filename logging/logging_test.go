@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	var output bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewJSONHandler(&output, nil)))
+
+	ctx := WithAttrs(context.Background(), slog.String("request_id", "abc"))
+	ctx = WithAttrs(ctx, slog.String("user", "nunya"))
+
+	logger.With("component", "git").InfoContext(ctx, "running", "command", "upload-pack")
+
+	var got map[string]any
+	err := json.Unmarshal(output.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{"request_id": "abc", "user": "nunya", "component": "git", "command": "upload-pack"} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %s", key, got[key], want)
+		}
+	}
+
+	output.Reset()
+	logger.Info("without context")
+
+	if bytes.Contains(output.Bytes(), []byte("request_id")) {
+		t.Errorf("record logged without a context has request_id: %s", output.String())
+	}
+}
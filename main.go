@@ -1,138 +1,466 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"gitgud/auth"
 	"gitgud/config"
+	"gitgud/daemon"
 	"gitgud/git"
-	"log"
+	"gitgud/lfs"
+	"gitgud/limit"
+	"gitgud/logging"
+	"gitgud/pktline"
+	"gitgud/protection"
+	"gitgud/sshd"
+	"gitgud/webhook"
+	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	handler := GetRouter()
-	server := http.Server{
-		Addr:    "0.0.0.0:1323",
-		Handler: handler,
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	slog.Info("Listening on port: 1323")
-	err := server.ListenAndServe()
+	ParseTemplates("templates/")
+
+	// Handlers log with the context of their request, which carries its ID
+	slog.SetDefault(slog.New(logging.NewHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: config.Settings.LogLevel}))))
+
+	// Requests and services are cancelled once a shutdown runs out of time
+	baseContext, cancelServices := context.WithCancelCause(context.Background())
+
+	httpListeners, err := openHTTPListeners(config.Settings.Server, GetRouter(), baseContext)
 	if err != nil {
+		slog.Error("Failed to start server", "error", err)
+		return
+	}
+
+	if address := config.Settings.Server.MetricsAddress; address != "" {
+		metricsListener, err := openMetricsListener(address, baseContext)
+		if err != nil {
+			slog.Error("Failed to start metrics server", "error", err)
+			return
+		}
+		httpListeners = append(httpListeners, metricsListener)
+	}
+
+	var listeners []io.Closer
+
+	if config.Settings.SSH.Enabled {
+		sshServer, err := sshd.NewServer(config.Settings.SSH)
+		if err != nil {
+			slog.Error("Failed to start ssh server", "error", err)
+			return
+		}
+		sshServer.BaseContext = baseContext
+		listeners = append(listeners, sshServer)
+
+		go func() {
+			err := sshServer.ListenAndServe()
+			slog.Error("SSH server closed", "error", err)
+		}()
+	}
+
+	if config.Settings.Daemon.Enabled {
+		daemonServer := daemon.NewServer(config.Settings.Daemon)
+		daemonServer.BaseContext = baseContext
+		listeners = append(listeners, daemonServer)
+
+		go func() {
+			err := daemonServer.ListenAndServe()
+			slog.Error("Git daemon closed", "error", err)
+		}()
+	}
+
+	go webhook.DefaultQueue().Run()
+
+	if config.Settings.Server.PushToCreate && config.Settings.Server.PushToCreateTimeout > 0 {
+		go runAbandonedRepositorySweeps(baseContext)
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	servers := []*http.Server{}
+	served := make(chan error, len(httpListeners))
+	for _, httpListener := range httpListeners {
+		if !slices.Contains(servers, httpListener.server) {
+			servers = append(servers, httpListener.server)
+		}
+
+		go func() {
+			slog.Info("Listening for HTTP", "address", httpListener.listener.Addr(), "tls", httpListener.tls)
+			served <- httpListener.serve()
+		}()
+	}
+
+	select {
+	case err := <-served:
 		slog.Error("Server closed", "error", err)
+		return
+	case <-signals.Done():
 	}
+
+	// A second signal stops the server without waiting
+	stop()
+
+	shutdown(servers, listeners, cancelServices)
 }
 
-func GetRouter() *http.ServeMux {
+func GetRouter() http.Handler {
+	authn := authenticator{
+		users:  auth.NewUserStore(config.Settings.Auth.UsersPath),
+		tokens: auth.NewTokenStore(config.Settings.Auth.TokensPath),
+	}
+
+	lfsHandler := lfsHandlers{store: lfs.NewStore(config.Settings.LFS.StoragePath)}
+
 	router := http.NewServeMux()
-	router.Handle("GET /{orgName}/{repositoryName}/info/refs", errorHandler(GetServiceHandler))
-	router.Handle("POST /{orgName}/{repositoryName}/{service}", errorHandler(PostServiceHandler))
-	return router
+	router.Handle("GET /{$}", authn.identify(HomeHandler))
+	router.Handle("GET /{orgName}", authn.identify(OrgHandler))
+	router.Handle("GET /static/{file}", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	router.Handle("GET /{orgName}/{repositoryName}/info/refs", authn.identify(createOnPush(checkAccess(auth.ReadAccess, gitService(GetServiceHandler)))))
+	router.Handle("POST /{orgName}/{repositoryName}/{service}", authn.requireAccess(auth.ReadAccess, gitService(PostServiceHandler)))
+	router.Handle("GET /{orgName}/{repositoryName}/HEAD", authn.requireAccess(auth.ReadAccess, DumbFileHandler))
+	router.Handle("GET /{orgName}/{repositoryName}/objects/info/packs", authn.requireAccess(auth.ReadAccess, DumbInfoPacksHandler))
+	router.Handle("GET /{orgName}/{repositoryName}/objects/{directory}/{file}", authn.requireAccess(auth.ReadAccess, DumbFileHandler))
+	router.Handle("GET /{orgName}/{repositoryName}", repositoryPath(authn.requireAccess(auth.ReadAccess, RepositoryHandler)))
+	router.Handle("GET /{orgName}/{repositoryName}/tree/{ref}", repositoryPath(authn.requireAccess(auth.ReadAccess, TreeHandler)))
+	router.Handle("GET /{orgName}/{repositoryName}/tree/{ref}/{path...}", repositoryPath(authn.requireAccess(auth.ReadAccess, TreeHandler)))
+	router.Handle("DELETE /{orgName}/{repositoryName}", authn.requireAccess(auth.AdminAccess, DeleteRepositoryHandler))
+	router.Handle("GET /{orgName}/{repositoryName}/webhooks/deliveries", authn.requireAccess(auth.AdminAccess, WebhookDeliveriesHandler))
+	router.Handle("POST /{orgName}/{repositoryName}/info/lfs/objects/batch", authn.requireAccess(auth.ReadAccess, lfsHandler.BatchHandler))
+	router.Handle("POST /{orgName}/{repositoryName}/info/lfs/objects/verify", authn.requireAccess(auth.WriteAccess, lfsHandler.VerifyHandler))
+	router.Handle("PUT /{orgName}/{repositoryName}/info/lfs/objects/{oid}", authn.requireAccess(auth.WriteAccess, lfsHandler.UploadHandler))
+	router.Handle("GET /{orgName}/{repositoryName}/info/lfs/objects/{oid}", authn.requireAccess(auth.ReadAccess, lfsHandler.DownloadHandler))
+	router.Handle("POST /{orgName}/{repositoryName}/info/lfs/locks", authn.requireAccess(auth.WriteAccess, lfsHandler.CreateLockHandler))
+	router.Handle("GET /{orgName}/{repositoryName}/info/lfs/locks", authn.requireAccess(auth.ReadAccess, lfsHandler.ListLocksHandler))
+	router.Handle("POST /{orgName}/{repositoryName}/info/lfs/locks/verify", authn.requireAccess(auth.WriteAccess, lfsHandler.VerifyLocksHandler))
+	router.Handle("POST /{orgName}/{repositoryName}/info/lfs/locks/{id}/unlock", authn.requireAccess(auth.WriteAccess, lfsHandler.UnlockHandler))
+	router.Handle("GET /healthz", errorHandler(HealthzHandler))
+	router.Handle("GET /readyz", errorHandler(ReadyzHandler))
+	return accessLog(mountRouter(router, config.Settings.Server))
 }
 
-func PostServiceHandler(writer http.ResponseWriter, request *http.Request) error {
-	repositoryName := request.PathValue("repositoryName")
-	orgName := request.PathValue("orgName")
+func PostServiceHandler(writer http.ResponseWriter, request *http.Request) (err error) {
+	start := time.Now()
 
-	if !strings.HasSuffix(repositoryName, ".git") {
-		return fmt.Errorf("invalid repository name %s", repositoryName)
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
 	}
 
-	repositoryName = strings.ReplaceAll(repositoryName, ".git", "")
+	service := request.PathValue("service")
+	if !slices.Contains([]string{"git-upload-pack", "git-receive-pack"}, service) {
+		return notFound(fmt.Sprintf("unknown service: %s", service))
+	}
 
-	remoteRepo, err := git.NewRemoteRepository(config.Settings.BaseURL, orgName, repositoryName)
+	protocolVersion, err := git.NegotiateProtocolVersion(service, request.Header.Get("Git-Protocol"), config.Settings.Server.ProtocolVersions)
 	if err != nil {
-		return err
+		return forbidden(err)
 	}
+	remoteRepo.ProtocolVersion = protocolVersion
 
-	logWriter := LogWriter{writer}
+	defer func() { observeGitRequest(service, phaseRPC, start, err) }()
 
-	service := request.PathValue("service")
-	if !slices.Contains([]string{"git-upload-pack", "git-receive-pack"}, service) {
-		return fmt.Errorf("unexpected service: %s", service)
+	services := limit.DefaultServices()
+	release, err := services.Acquire(request.Context(), service, remoteRepo)
+	if errors.Is(err, limit.ErrBusy) {
+		return serviceBusy(err, services.Settings.RetryAfter)
+	}
+	if err != nil {
+		return &HTTPError{Status: statusClientClosedRequest, Message: "request cancelled", Err: err}
 	}
+	defer release()
+
+	ctx, cancel := git.WithServiceTimeout(request.Context(), service, false)
+	defer cancel()
 
 	writer.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
 
-	command := remoteRepo.CallService(service, false)
+	command := remoteRepo.CallService(ctx, service, false)
+
+	entry := accessEntryFromRequest(request)
+	entry.service = service
+	defer entry.setExitCode(command)
 
 	// Passing the body from the request into the git service command
-	command.Stdin = request.Body
-	command.Stdout = logWriter
+	received := &countingReader{Reader: request.Body}
+	sent := &countingWriter{Writer: writer}
+	defer countGitBytes(service, received, sent)
+
+	var stdin io.Reader = received
+	var stdout io.Writer = sent
+
+	// Scanning stops at the pack, which streams straight to the client
+	fetch := &fetchScanner{}
+	if service == "git-upload-pack" {
+		stdin = io.TeeReader(stdin, fetch.Request())
+		stdout = io.MultiWriter(stdout, fetch.Response())
+	}
+
+	if config.Settings.Debug {
+		requestTracer, responseTracer := newPacketTracers(ctx, service, remoteRepo)
+		defer requestTracer.Close()
+		defer responseTracer.Close()
+
+		stdin = io.TeeReader(stdin, requestTracer)
+		stdout = io.MultiWriter(stdout, responseTracer)
+	}
+
+	var push *webhook.Push
+	var pushCreated bool
+	var announcer *creationAnnouncer
+	if service == "git-receive-pack" {
+		// Pushes always come from an authenticated user
+		user, _ := auth.UserFromContext(request.Context())
+		protectionEnv, err := protection.Environment(ctx, remoteRepo.GitRepository, user.Name)
+		if err != nil {
+			return err
+		}
+		command.Env = append(command.Env, protectionEnv...)
+
+		push, err = webhook.BeginPush(ctx, remoteRepo, user.Name)
+		if err != nil {
+			return err
+		}
+
+		_, pushCreated, err = pushCreatedAt(ctx, remoteRepo)
+		if err != nil {
+			return err
+		}
+
+		if pushCreated {
+			var sideband bool
+			sideband, stdin, err = pushUsesSideband(stdin)
+			if err != nil {
+				return err
+			}
+
+			if sideband {
+				announcer = &creationAnnouncer{writer: stdout}
+				stdout = announcer
+			}
+		}
+	}
+
+	command.Stdin = stdin
+	command.Stdout = stdout
 
 	var stdErr strings.Builder
 	command.Stderr = &stdErr
 
-	err = command.Run()
+	err = git.Run(command)
+
+	// The repository created for the push only stays if something landed,
+	// whether the push went through or not
+	created := false
+	if pushCreated {
+		var settleErr error
+		created, settleErr = settlePushCreated(context.WithoutCancel(ctx), remoteRepo)
+		if settleErr != nil {
+			slog.ErrorContext(request.Context(), "failed to settle repository created by push", "error", settleErr)
+		}
+	}
 
 	if err != nil {
-		return fmt.Errorf("failure calling service %s: %w", service, err)
+		if announcer != nil {
+			announcer.Close()
+		}
+		return serviceError(ctx, service, remoteRepo, err, stdErr.String())
 	}
 
-	return err
-}
+	countGitOperation(remoteRepo, service, fetch)
 
-func GetServiceHandler(writer http.ResponseWriter, request *http.Request) error {
-	repositoryName := request.PathValue("repositoryName")
-	orgName := request.PathValue("orgName")
+	// Cleaning up after a push that went through can't be left half done
+	ctx = context.WithoutCancel(ctx)
 
-	if !strings.HasSuffix(repositoryName, ".git") {
-		return fmt.Errorf("invalid repository name %s", repositoryName)
+	if announcer != nil {
+		if created {
+			err = announcer.Announce(remoteRepo)
+		} else {
+			err = announcer.Close()
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	repositoryName = strings.ReplaceAll(repositoryName, ".git", "")
+	if push != nil {
+		// The push went through, a failure here is only worth logging
+		err = push.Finish(ctx, webhook.DefaultQueue())
+		if err != nil {
+			slog.ErrorContext(request.Context(), "failed to queue webhooks", "error", err)
+		}
+	}
 
-	remoteRepo, err := git.NewRemoteRepository(config.Settings.BaseURL, orgName, repositoryName)
+	return nil
+}
+
+func GetServiceHandler(writer http.ResponseWriter, request *http.Request) (err error) {
+	start := time.Now()
+
+	service := request.URL.Query().Get("service")
+	if service == "" {
+		// Clients that don't send a service only speak the dumb protocol
+		return DumbInfoRefsHandler(writer, request)
+	}
+
+	remoteRepo, err := remoteRepositoryFromRequest(request)
 	if err != nil {
 		return err
 	}
 
-	logWriter := LogWriter{writer}
-
-	service := request.URL.Query().Get("service")
 	if !slices.Contains([]string{"git-upload-pack", "git-receive-pack"}, service) {
-		return fmt.Errorf("unexpected service: %s", service)
+		return badRequest(fmt.Errorf("unknown service: %s", service))
 	}
 
+	protocolVersion, err := git.NegotiateProtocolVersion(service, request.Header.Get("Git-Protocol"), config.Settings.Server.ProtocolVersions)
+	if err != nil {
+		return forbidden(err)
+	}
+	remoteRepo.ProtocolVersion = protocolVersion
+
+	defer func() { observeGitRequest(service, phaseAdvertisement, start, err) }()
+
 	writer.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
 
-	// Write the service when advertising
-	fmt.Fprintf(logWriter, "%04x# service=%s\n", len("# service="+service)+5, service)
-	logWriter.Write([]byte("0000"))
+	sent := &countingWriter{Writer: writer}
+	defer countGitBytes(service, nil, sent)
+
+	var output io.Writer = sent
+	if config.Settings.Debug {
+		_, responseTracer := newPacketTracers(request.Context(), service, remoteRepo)
+		defer responseTracer.Close()
+
+		output = io.MultiWriter(sent, responseTracer)
+	}
 
-	command := remoteRepo.CallService(service, true)
+	// Write the service when advertising, version 2 responses start with the
+	// capability advertisement instead
+	if protocolVersion != 2 {
+		packetWriter := pktline.NewWriter(output)
+
+		err = packetWriter.WriteString(fmt.Sprintf("# service=%s\n", service))
+		if err != nil {
+			return err
+		}
+
+		err = packetWriter.WriteFlush()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := git.WithServiceTimeout(request.Context(), service, true)
+	defer cancel()
+
+	command := remoteRepo.CallService(ctx, service, true)
+
+	entry := accessEntryFromRequest(request)
+	entry.service = service
+	defer entry.setExitCode(command)
 
 	var stdErr strings.Builder
-	command.Stdout = logWriter
+	command.Stdout = output
 	command.Stderr = &stdErr
 
-	err = command.Run()
+	err = git.Run(command)
 
 	if err != nil {
-		return fmt.Errorf("failure calling service %s: %w", service, err)
+		return serviceError(ctx, service, remoteRepo, err, stdErr.String())
 	}
 
 	return err
 }
 
+func DeleteRepositoryHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	err = remoteRepo.DeleteRepo(request.Context())
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(request.Context(), "repository deleted", "org", remoteRepo.OrgName, "repository", remoteRepo.Name)
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func WebhookDeliveriesHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := webhook.DefaultQueue().Log(remoteRepo.OrgName + "/" + remoteRepo.Name)
+	if err != nil {
+		return err
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(writer).Encode(deliveries)
+}
+
+// Resolve the remote repository addressed by the orgName and repositoryName
+// path values of the request.
+func remoteRepositoryFromRequest(request *http.Request) (git.GitRemoteRepository, error) {
+	repositoryName := request.PathValue("repositoryName")
+	orgName := request.PathValue("orgName")
+
+	if !strings.HasSuffix(repositoryName, ".git") {
+		return git.GitRemoteRepository{}, badRequest(fmt.Errorf("invalid repository name %s", repositoryName))
+	}
+
+	repositoryName = strings.ReplaceAll(repositoryName, ".git", "")
+
+	remoteRepo, err := git.NewRemoteRepository(mountURL(request), orgName, repositoryName)
+	if err != nil {
+		return git.GitRemoteRepository{}, badRequest(err)
+	}
+
+	entry := accessEntryFromRequest(request)
+	entry.org = remoteRepo.OrgName
+	entry.repository = remoteRepo.Name
+
+	return remoteRepo, nil
+}
+
 type errorHandler func(http.ResponseWriter, *http.Request) error
 
 func (fn errorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := fn(w, r)
 	if err != nil {
-		slog.Error("Unexpected error in ServeHTTP", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status, message := errorResponse(err)
+		logRequestError(r, status, err)
+		setErrorHeaders(w, err)
+		http.Error(w, message, status)
 		return
 	}
 }
 
-type LogWriter struct {
-	ResponseWriter http.ResponseWriter
-}
-
-func (w LogWriter) Write(p []byte) (n int, err error) {
-	log.Println("writing: ", string(p))
-	return w.ResponseWriter.Write(p)
+// Return tracers that log what the client sent and what the service answered,
+// for debugging the wire protocol
+func newPacketTracers(ctx context.Context, service string, remoteRepo git.GitRemoteRepository) (*pktline.Tracer, *pktline.Tracer) {
+	logger := logging.FromContext(ctx).With("service", service, "org", remoteRepo.OrgName, "repository", remoteRepo.Name)
+	return pktline.NewTracer(logger.With("direction", "request")), pktline.NewTracer(logger.With("direction", "response"))
 }
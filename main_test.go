@@ -1,14 +1,95 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"gitgud/auth"
+	"gitgud/config"
 	"gitgud/git"
+	"gitgud/limit"
+	"gitgud/logging"
+	"gitgud/webhook"
+	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Pushes to protected branches run the test binary as their update hook
+	if len(os.Args) > 1 && os.Args[1] == "hook" {
+		err := runCommand(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	ParseTemplates("templates/")
+
+	os.Exit(m.Run())
+}
+
+const (
+	testUserName     = "nunya"
+	testUserPassword = "bidness"
+)
+
+// Add the test user to the user store for the duration of the test
+func newTestUser(t *testing.T) {
+	t.Helper()
+
+	users := auth.NewUserStore(config.Settings.Auth.UsersPath)
+	err := users.SetPassword(testUserName, testUserPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Remove(config.Settings.Auth.UsersPath) })
+}
+
+// Give the test user the access level on the repository
+func grantTestUser(t *testing.T, remoteRepo git.GitRemoteRepository, level string) {
+	t.Helper()
+
+	err := remoteRepo.SetConfig(context.Background(), fmt.Sprintf("access.%s.level", testUserName), level)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Return the URL of the test server with the credentials of the test user
+func authenticatedURL(t *testing.T, ts *httptest.Server) string {
+	t.Helper()
+
+	newTestUser(t)
+	return strings.Replace(ts.URL, "http://", fmt.Sprintf("http://%s:%s@", testUserName, testUserPassword), 1)
+}
+
 func TestDefaultBranch(t *testing.T) {
 	if testing.Verbose() {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
@@ -21,16 +102,18 @@ func TestDefaultBranch(t *testing.T) {
 	ts := httptest.NewServer(router)
 	defer ts.Close()
 
-	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", remoteRepoName)
+	testRepo, err := git.NewRemoteRepository(authenticatedURL(t, ts), "test_org", remoteRepoName)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = testRepo.CreateBareRepo()
+	err = testRepo.CreateBareRepo(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer testRepo.DeleteRepo()
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "write")
 
 	contents, err := os.ReadFile(fmt.Sprintf("%s/HEAD", testRepo.FullPath))
 	if err != nil {
@@ -42,13 +125,13 @@ func TestDefaultBranch(t *testing.T) {
 		t.Fatalf("HEAD contents -> expected: %s, got %s", expected, contents)
 	}
 
-	clonedRepo, err := testRepo.Clone(clonedRepoName)
+	clonedRepo, err := testRepo.Clone(context.Background(), clonedRepoName)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer clonedRepo.DeleteRepo()
+	defer clonedRepo.DeleteRepo(context.Background())
 
-	branchName, err := clonedRepo.GetBranch()
+	branchName, err := clonedRepo.GetBranch(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,22 +153,24 @@ func TestClone(t *testing.T) {
 	ts := httptest.NewServer(router)
 	defer ts.Close()
 
-	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", remoteRepoName)
+	testRepo, err := git.NewRemoteRepository(authenticatedURL(t, ts), "test_org", remoteRepoName)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = testRepo.CreateBareRepo()
+	err = testRepo.CreateBareRepo(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer testRepo.DeleteRepo()
+	defer testRepo.DeleteRepo(context.Background())
 
-	clonedRepo, err := testRepo.Clone(clonedRepoName1)
+	grantTestUser(t, testRepo, "write")
+
+	clonedRepo, err := testRepo.Clone(context.Background(), clonedRepoName1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer clonedRepo.DeleteRepo()
+	defer clonedRepo.DeleteRepo(context.Background())
 
 	// Create new file, add, commit and push to remote
 	// TODO: Look at file perms
@@ -94,39 +179,39 @@ func TestClone(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = clonedRepo.AddAll()
+	err = clonedRepo.AddAll(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = clonedRepo.SetConfig("user.name", "Nunya Bidness")
+	err = clonedRepo.SetConfig(context.Background(), "user.name", "Nunya Bidness")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = clonedRepo.SetConfig("user.email", "nunya@bidness.com")
+	err = clonedRepo.SetConfig(context.Background(), "user.email", "nunya@bidness.com")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = clonedRepo.Commit("Initial commit")
+	err = clonedRepo.Commit(context.Background(), "Initial commit")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = clonedRepo.Push()
+	err = clonedRepo.Push(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Clone repo elsewhere and verify contents
 
-	otherClonedRepo, err := testRepo.Clone(clonedRepoName2)
+	otherClonedRepo, err := testRepo.Clone(context.Background(), clonedRepoName2)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	defer otherClonedRepo.DeleteRepo()
+	defer otherClonedRepo.DeleteRepo(context.Background())
 
 	contents, err := os.ReadFile(fmt.Sprintf("%s/readme.md", otherClonedRepo.FullPath))
 	if err != nil {
@@ -137,3 +222,2218 @@ func TestClone(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestProtocolVersionAdvertisement(t *testing.T) {
+	tests := []struct {
+		name        string // description of this test case
+		service     string
+		gitProtocol string
+		wantPrefix  string
+	}{
+		{
+			name:        "upload-pack without header",
+			service:     "git-upload-pack",
+			gitProtocol: "",
+			wantPrefix:  "001e# service=git-upload-pack\n0000",
+		},
+		{
+			name:        "upload-pack version 1",
+			service:     "git-upload-pack",
+			gitProtocol: "version=1",
+			wantPrefix:  "001e# service=git-upload-pack\n0000000eversion 1\n",
+		},
+		{
+			name:        "upload-pack version 2",
+			service:     "git-upload-pack",
+			gitProtocol: "version=2",
+			wantPrefix:  "000eversion 2\n",
+		},
+		{
+			name:        "receive-pack version 2 falls back to 1",
+			service:     "git-receive-pack",
+			gitProtocol: "version=2",
+			wantPrefix:  "001f# service=git-receive-pack\n0000000eversion 1\n",
+		},
+	}
+
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	newTestUser(t)
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "write")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := fmt.Sprintf("%s/test_org/test_repo_protocol.git/info/refs?service=%s", ts.URL, tt.service)
+			request, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.SetBasicAuth(testUserName, testUserPassword)
+			if tt.gitProtocol != "" {
+				request.Header.Set("Git-Protocol", tt.gitProtocol)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status -> expected: %d, got %d (%s)", http.StatusOK, response.StatusCode, body)
+			}
+
+			if !strings.HasPrefix(string(body), tt.wantPrefix) {
+				t.Errorf("advertisement -> expected prefix: %q, got %q", tt.wantPrefix, body)
+			}
+		})
+	}
+}
+
+// Commit the given files to the remote repository by pushing to it straight
+// through the filesystem, leaving the HTTP routes out of the picture.
+func pushTestCommit(t *testing.T, remoteRepo git.GitRemoteRepository, files map[string]string) {
+	t.Helper()
+
+	localRemote := remoteRepo
+	localRemote.CloneURL = remoteRepo.FullPath
+
+	clonedRepo, err := localRemote.Clone(context.Background(), remoteRepo.Name+"_local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clonedRepo.DeleteRepo(context.Background())
+
+	for name, contents := range files {
+		path := fmt.Sprintf("%s/%s", clonedRepo.FullPath, name)
+		err = os.MkdirAll(filepath.Dir(path), 0750)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(path, []byte(contents), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = clonedRepo.AddAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = clonedRepo.SetConfig(context.Background(), "user.name", "Nunya Bidness")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = clonedRepo.SetConfig(context.Background(), "user.email", "nunya@bidness.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = clonedRepo.Commit(context.Background(), "Test commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = clonedRepo.Push(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumbClone(t *testing.T) {
+	fileContents := "This is a readme"
+
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_dumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	pushTestCommit(t, testRepo, map[string]string{"readme.md": fileContents})
+
+	err = testRepo.SetConfig(context.Background(), "gitgud.anonymousRead", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloneURL := fmt.Sprintf("%s/test_org/test_repo_dumb.git", ts.URL)
+	clonePath := t.TempDir()
+
+	// Disabled by default
+	command := exec.Command("git", "clone", cloneURL, clonePath)
+	command.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	output, err := command.CombinedOutput()
+	if err == nil {
+		t.Fatalf("dumb clone succeeded while disabled: %s", output)
+	}
+
+	err = testRepo.SetConfig(context.Background(), "gitgud.dumbHttp", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command = exec.Command("git", "clone", cloneURL, clonePath)
+	command.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	output, err = command.CombinedOutput()
+	if err != nil {
+		t.Fatalf("dumb clone failed: %s", output)
+	}
+
+	contents, err := os.ReadFile(fmt.Sprintf("%s/readme.md", clonePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != fileContents {
+		t.Fatalf("readme contents -> expected: %s, got %s", fileContents, contents)
+	}
+
+	// Dumb HTTP stays read-only
+	response, err := http.Post(cloneURL+"/objects/info/packs", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusOK {
+		t.Fatalf("POST to dumb route -> expected failure, got %d", response.StatusCode)
+	}
+
+	refs, err := testRepo.GetRefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := refs["refs/heads/main"]
+	objectPath := fmt.Sprintf("/objects/%s/%s", head[:2], head[2:])
+
+	// Shared caches may only keep objects anyone may fetch
+	objectCacheControl := func(url string) string {
+		t.Helper()
+
+		response, err := http.Get(url + objectPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("GET of %s -> expected 200, got %d", objectPath, response.StatusCode)
+		}
+
+		return response.Header.Get("Cache-Control")
+	}
+
+	if cacheControl := objectCacheControl(cloneURL); !strings.HasPrefix(cacheControl, "public,") {
+		t.Errorf("Cache-Control of an anonymously readable repository -> expected public, got %q", cacheControl)
+	}
+
+	err = testRepo.UnsetConfig(context.Background(), "gitgud.anonymousRead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grantTestUser(t, testRepo, "read")
+
+	if cacheControl := objectCacheControl(authenticatedURL(t, ts) + "/test_org/test_repo_dumb.git"); !strings.HasPrefix(cacheControl, "private,") {
+		t.Errorf("Cache-Control of a private repository -> expected private, got %q", cacheControl)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	newTestUser(t)
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "write")
+
+	tests := []struct {
+		name          string // description of this test case
+		service       string
+		user          string
+		password      string
+		anonymousRead bool
+		wantStatus    int
+	}{
+		{
+			name:       "anonymous clone",
+			service:    "git-upload-pack",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "anonymous clone with anonymous reads",
+			service:       "git-upload-pack",
+			anonymousRead: true,
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "anonymous push with anonymous reads",
+			service:       "git-receive-pack",
+			anonymousRead: true,
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong password",
+			service:    "git-receive-pack",
+			user:       testUserName,
+			password:   "business",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "authenticated push",
+			service:    "git-receive-pack",
+			user:       testUserName,
+			password:   testUserPassword,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testRepo.SetConfig(context.Background(), "gitgud.anonymousRead", fmt.Sprint(tt.anonymousRead))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			url := fmt.Sprintf("%s/test_org/test_repo_auth.git/info/refs?service=%s", ts.URL, tt.service)
+			request, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user != "" {
+				request.SetBasicAuth(tt.user, tt.password)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("status -> expected: %d, got %d", tt.wantStatus, response.StatusCode)
+			}
+
+			if tt.wantStatus == http.StatusUnauthorized && response.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("401 response without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	newTestUser(t)
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	tests := []struct {
+		name       string // description of this test case
+		orgConfig  string
+		repoLevel  string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "no access",
+			method:     http.MethodGet,
+			path:       "/info/refs?service=git-upload-pack",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "read access clone",
+			repoLevel:  "read",
+			method:     http.MethodGet,
+			path:       "/info/refs?service=git-upload-pack",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "read access push",
+			repoLevel:  "read",
+			method:     http.MethodGet,
+			path:       "/info/refs?service=git-receive-pack",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "org default inherited",
+			orgConfig:  "[access]\n\tdefault = write\n",
+			method:     http.MethodGet,
+			path:       "/info/refs?service=git-receive-pack",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "repository overrides org default",
+			orgConfig:  "[access]\n\tdefault = write\n",
+			repoLevel:  "read",
+			method:     http.MethodGet,
+			path:       "/info/refs?service=git-receive-pack",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "write access delete",
+			repoLevel:  "write",
+			method:     http.MethodDelete,
+			path:       "",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(testRepo.OrgConfigPath())
+			if tt.orgConfig != "" {
+				err = os.WriteFile(testRepo.OrgConfigPath(), []byte(tt.orgConfig), 0640)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.Remove(testRepo.OrgConfigPath())
+			}
+
+			err := testRepo.UnsetConfig(context.Background(), fmt.Sprintf("access.%s.level", testUserName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.repoLevel != "" {
+				grantTestUser(t, testRepo, tt.repoLevel)
+			}
+
+			url := fmt.Sprintf("%s/test_org/test_repo_authz.git%s", ts.URL, tt.path)
+			request, err := http.NewRequest(tt.method, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.SetBasicAuth(testUserName, testUserPassword)
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("status -> expected: %d, got %d", tt.wantStatus, response.StatusCode)
+			}
+		})
+	}
+
+	// Admins can delete the repository
+	grantTestUser(t, testRepo, "admin")
+
+	request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/test_org/test_repo_authz.git", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(testUserName, testUserPassword)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete status -> expected: %d, got %d", http.StatusNoContent, response.StatusCode)
+	}
+
+	if _, err := os.Stat(testRepo.FullPath); err == nil {
+		t.Fatal("repository still exists after delete")
+	}
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	newTestUser(t)
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "write")
+
+	tokens := auth.NewTokenStore(config.Settings.Auth.TokensPath)
+	defer os.Remove(config.Settings.Auth.TokensPath)
+	defer os.Remove(tokens.LastUsedPath)
+
+	secret, token, err := tokens.Create(testUserName, "ci", []auth.Scope{auth.ScopeRepoRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(service string, authorize func(*http.Request)) int {
+		url := fmt.Sprintf("%s/test_org/test_repo_token.git/info/refs?service=%s", ts.URL, service)
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorize(request)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	basic := func(request *http.Request) { request.SetBasicAuth("x-token", secret) }
+	bearer := func(request *http.Request) { request.Header.Set("Authorization", "Bearer "+secret) }
+
+	if status := get("git-upload-pack", basic); status != http.StatusOK {
+		t.Errorf("clone with token as password -> expected: %d, got %d", http.StatusOK, status)
+	}
+
+	if status := get("git-upload-pack", bearer); status != http.StatusOK {
+		t.Errorf("clone with bearer token -> expected: %d, got %d", http.StatusOK, status)
+	}
+
+	// The user may push but the token is only scoped for reading
+	if status := get("git-receive-pack", basic); status != http.StatusForbidden {
+		t.Errorf("push with read token -> expected: %d, got %d", http.StatusForbidden, status)
+	}
+
+	err = tokens.Revoke(token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := get("git-upload-pack", basic); status != http.StatusUnauthorized {
+		t.Errorf("clone with revoked token -> expected: %d, got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestBranchProtection(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_protected")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	cloneURL := fmt.Sprintf("%s/test_org/test_repo_protected.git", authenticatedURL(t, ts))
+	grantTestUser(t, testRepo, "write")
+
+	clonePath := t.TempDir()
+	gitCommand := func(args ...string) (string, error) {
+		command := exec.Command("git", args...)
+		command.Dir = clonePath
+		command.Env = append(os.Environ(),
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_AUTHOR_NAME=Nunya Bidness",
+			"GIT_AUTHOR_EMAIL=nunya@bidness.com",
+			"GIT_COMMITTER_NAME=Nunya Bidness",
+			"GIT_COMMITTER_EMAIL=nunya@bidness.com",
+		)
+		output, err := command.CombinedOutput()
+		return string(output), err
+	}
+
+	for _, args := range [][]string{
+		{"clone", cloneURL, "."},
+		{"commit", "--allow-empty", "-m", "First"},
+		{"push", "origin", "HEAD:main"},
+		{"commit", "--allow-empty", "-m", "Second"},
+		{"push", "origin", "HEAD:main"},
+		{"push", "origin", "HEAD:release/1.x"},
+	} {
+		output, err := gitCommand(args...)
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, output)
+		}
+	}
+
+	err = testRepo.SetConfig(context.Background(), "protect.main.pusher", "somebody")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.SetConfig(context.Background(), "protect.release/*.allowForcePush", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := gitCommand("push", "origin", "HEAD:main")
+	if err != nil {
+		t.Fatalf("push without changes failed: %s", output)
+	}
+
+	output, err = gitCommand("commit", "--allow-empty", "-m", "Third")
+	if err != nil {
+		t.Fatal(output)
+	}
+
+	tests := []struct {
+		name       string // description of this test case
+		pusher     string
+		args       []string
+		wantReason string
+	}{
+		{
+			name:       "not an allowed pusher",
+			pusher:     "somebody",
+			args:       []string{"push", "origin", "HEAD:main"},
+			wantReason: "nunya is not allowed to push, only somebody",
+		},
+		{
+			name:       "force push",
+			pusher:     testUserName,
+			args:       []string{"push", "--force", "origin", "HEAD~2:main"},
+			wantReason: "force push is not allowed",
+		},
+		{
+			name:       "deletion",
+			pusher:     testUserName,
+			args:       []string{"push", "origin", ":release/1.x"},
+			wantReason: "deletion is not allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testRepo.SetConfig(context.Background(), "protect.main.pusher", tt.pusher)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, err := gitCommand(tt.args...)
+			if err == nil {
+				t.Fatalf("push succeeded unexpectedly: %s", output)
+			}
+
+			if !strings.Contains(output, "[remote rejected]") || !strings.Contains(output, tt.wantReason) {
+				t.Errorf("push output -> expected rejection with %q, got %s", tt.wantReason, output)
+			}
+		})
+	}
+
+	// The repository's own hooks still run after the protection
+	updatedPath := filepath.Join(t.TempDir(), "updated")
+	for _, name := range []string{"update", "post-receive"} {
+		script := fmt.Sprintf("#!/bin/sh\necho %s \"$1\" >> '%s'\n", name, updatedPath)
+		err = os.WriteFile(filepath.Join(testRepo.FullPath, "hooks", name), []byte(script), 0750)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Allowed pushers can still fast-forward
+	output, err = gitCommand("push", "origin", "HEAD:main")
+	if err != nil {
+		t.Fatalf("fast-forward push by allowed pusher failed: %s", output)
+	}
+
+	updated, err := os.ReadFile(updatedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(updated) != "update refs/heads/main\npost-receive \n" {
+		t.Errorf("repository hooks ran %q, want the update and post-receive hooks", updated)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	events := make(chan string, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.Header.Get("X-Gitgud-Event")
+	}))
+	defer receiver.Close()
+	defer os.RemoveAll(config.Settings.Webhooks.QueuePath)
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	err = testRepo.SetConfig(context.Background(), "webhook.ci.url", receiver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseURL := authenticatedURL(t, ts)
+	grantTestUser(t, testRepo, "admin")
+
+	clonePath := t.TempDir()
+	for _, args := range [][]string{
+		{"clone", fmt.Sprintf("%s/test_org/test_repo_webhooks.git", baseURL), "."},
+		{"commit", "--allow-empty", "-m", "First"},
+		{"push", "origin", "HEAD:main"},
+	} {
+		command := exec.Command("git", args...)
+		command.Dir = clonePath
+		command.Env = append(os.Environ(),
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_AUTHOR_NAME=Nunya Bidness",
+			"GIT_AUTHOR_EMAIL=nunya@bidness.com",
+			"GIT_COMMITTER_NAME=Nunya Bidness",
+			"GIT_COMMITTER_EMAIL=nunya@bidness.com",
+		)
+		output, err := command.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, output)
+		}
+	}
+
+	err = webhook.DefaultQueue().DeliverDue(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event := <-events; event != "push" {
+		t.Errorf("received event %q, want push", event)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/test_org/test_repo_webhooks.git/webhooks/deliveries", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(testUserName, testUserPassword)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("deliveries status = %d, want 200", response.StatusCode)
+	}
+
+	var deliveries []webhook.Delivery
+	err = json.NewDecoder(response.Body).Decode(&deliveries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].Status != webhook.Delivered {
+		t.Errorf("deliveries = %+v, want a single delivered push", deliveries)
+	}
+}
+
+func TestLFS(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+	defer os.RemoveAll(config.Settings.LFS.StoragePath)
+
+	testRepo, err := git.NewRemoteRepository(config.Settings.BaseURL, "test_org", "test_repo_lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	newTestUser(t)
+	grantTestUser(t, testRepo, "read")
+
+	repoURL := ts.URL + "/test_org/test_repo_lfs.git"
+	lfsRequest := func(method, url string, body string) (int, string) {
+		t.Helper()
+
+		request, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.SetBasicAuth(testUserName, testUserPassword)
+		request.Header.Set("Accept", "application/vnd.git-lfs+json")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		responseBody, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return response.StatusCode, string(responseBody)
+	}
+
+	contents := "large binary asset"
+	sum := sha256.Sum256([]byte(contents))
+	oid := hex.EncodeToString(sum[:])
+	batch := fmt.Sprintf(`{"operation": "%%s", "transfers": ["basic"], "objects": [{"oid": "%s", "size": %d}]}`, oid, len(contents))
+
+	status, body := lfsRequest(http.MethodPost, repoURL+"/info/lfs/objects/batch", fmt.Sprintf(batch, "upload"))
+	if status != http.StatusForbidden {
+		t.Errorf("upload batch with read access -> expected 403, got %d: %s", status, body)
+	}
+
+	grantTestUser(t, testRepo, "write")
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/objects/batch", fmt.Sprintf(batch, "download"))
+	if status != http.StatusOK || !strings.Contains(body, `"code":404`) {
+		t.Errorf("download batch before upload -> expected a 404 object error, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/objects/batch", fmt.Sprintf(batch, "upload"))
+	if status != http.StatusOK {
+		t.Fatalf("upload batch -> expected 200, got %d: %s", status, body)
+	}
+
+	var response struct {
+		Objects []struct {
+			Actions map[string]struct {
+				Href   string            `json:"href"`
+				Header map[string]string `json:"header"`
+			} `json:"actions"`
+		} `json:"objects"`
+	}
+	err = json.Unmarshal([]byte(body), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := response.Objects[0].Actions["upload"]
+	if upload.Href != testRepo.CloneURL+"/info/lfs/objects/"+oid || upload.Header["Authorization"] == "" {
+		t.Errorf("unexpected upload action %+v", upload)
+	}
+
+	status, body = lfsRequest(http.MethodPut, repoURL+"/info/lfs/objects/"+oid, "corrupted")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("upload of mismatched contents -> expected 422, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPut, repoURL+"/info/lfs/objects/"+oid, contents)
+	if status != http.StatusOK {
+		t.Fatalf("upload -> expected 200, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/objects/verify", fmt.Sprintf(`{"oid": "%s", "size": %d}`, oid, len(contents)))
+	if status != http.StatusOK {
+		t.Errorf("verify -> expected 200, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/objects/batch", fmt.Sprintf(batch, "download"))
+	if status != http.StatusOK || !strings.Contains(body, `"download"`) {
+		t.Errorf("download batch -> expected a download action, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodGet, repoURL+"/info/lfs/objects/"+oid, "")
+	if status != http.StatusOK || body != contents {
+		t.Errorf("download -> expected %q, got %d: %s", contents, status, body)
+	}
+
+	// Shared caches may only keep objects anyone may download
+	downloadCacheControl := func() string {
+		t.Helper()
+
+		request, err := http.NewRequest(http.MethodGet, repoURL+"/info/lfs/objects/"+oid, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.SetBasicAuth(testUserName, testUserPassword)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		return response.Header.Get("Cache-Control")
+	}
+
+	if cacheControl := downloadCacheControl(); !strings.HasPrefix(cacheControl, "private,") {
+		t.Errorf("Cache-Control of a private repository -> expected private, got %q", cacheControl)
+	}
+
+	err = testRepo.SetConfig(context.Background(), "gitgud.anonymousRead", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cacheControl := downloadCacheControl(); !strings.HasPrefix(cacheControl, "public,") {
+		t.Errorf("Cache-Control of an anonymously readable repository -> expected public, got %q", cacheControl)
+	}
+
+	err = testRepo.UnsetConfig(context.Background(), "gitgud.anonymousRead")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/locks", `{"path": "assets/logo.psd"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create lock -> expected 201, got %d: %s", status, body)
+	}
+
+	var created struct {
+		Lock struct {
+			ID string `json:"id"`
+		} `json:"lock"`
+	}
+	err = json.Unmarshal([]byte(body), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/locks", `{"path": "assets/logo.psd"}`)
+	if status != http.StatusConflict {
+		t.Errorf("create lock twice -> expected 409, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodGet, repoURL+"/info/lfs/locks?path=assets/logo.psd", "")
+	if status != http.StatusOK || !strings.Contains(body, created.Lock.ID) {
+		t.Errorf("list locks -> expected the lock, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/locks/verify", `{}`)
+	if status != http.StatusOK || !strings.Contains(body, `"theirs":[]`) || !strings.Contains(body, created.Lock.ID) {
+		t.Errorf("verify locks -> expected the lock to be ours, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/locks/"+created.Lock.ID+"/unlock", `{"force": true}`)
+	if status != http.StatusForbidden {
+		t.Errorf("forced unlock without admin -> expected 403, got %d: %s", status, body)
+	}
+
+	status, body = lfsRequest(http.MethodPost, repoURL+"/info/lfs/locks/"+created.Lock.ID+"/unlock", `{}`)
+	if status != http.StatusOK {
+		t.Errorf("unlock -> expected 200, got %d: %s", status, body)
+	}
+}
+
+func TestErrorReporting(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	baseURL := authenticatedURL(t, ts)
+	grantTestUser(t, testRepo, "write")
+
+	tests := []struct {
+		name       string // description of this test case
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "repository without .git",
+			method:     http.MethodGet,
+			path:       "/test_org/test_repo_errors/info/refs?service=git-upload-pack",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "invalid repository name test_repo_errors\n",
+		},
+		{
+			name:       "invalid org name",
+			method:     http.MethodGet,
+			path:       "/.test_org/test_repo_errors.git/info/refs?service=git-upload-pack",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "org name must not contain '/' or start with '.'\n",
+		},
+		{
+			name:       "unknown service advertisement",
+			method:     http.MethodGet,
+			path:       "/test_org/test_repo_errors.git/info/refs?service=git-upload-archive",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "unknown service: git-upload-archive\n",
+		},
+		{
+			name:       "unknown service",
+			method:     http.MethodPost,
+			path:       "/test_org/test_repo_errors.git/git-upload-archive",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "unknown service: git-upload-archive\n",
+		},
+		{
+			name:       "service failing inside the exchange",
+			method:     http.MethodPost,
+			path:       "/test_org/test_repo_errors.git/git-upload-pack",
+			body:       "garbage",
+			wantStatus: http.StatusOK,
+			wantBody:   "ERR git-upload-pack failed: protocol error: bad line length character: garb",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, baseURL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("status -> expected %d, got %d", tt.wantStatus, response.StatusCode)
+			}
+
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("body -> expected %q, got %q", tt.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestPushToCreate(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	config.Settings.Server.PushToCreate = true
+	defer func() { config.Settings.Server.PushToCreate = false }()
+
+	testRepo, err := git.NewRemoteRepository(config.Settings.BaseURL, "test_org_create", "test_repo_created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(testRepo.OrgConfigPath()))
+
+	baseURL := authenticatedURL(t, ts)
+	pushURL := fmt.Sprintf("%s/test_org_create/test_repo_created.git", baseURL)
+
+	clonePath := t.TempDir()
+	gitCommand := func(args ...string) (string, error) {
+		command := exec.Command("git", args...)
+		command.Dir = clonePath
+		command.Env = append(os.Environ(),
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_AUTHOR_NAME=Nunya Bidness",
+			"GIT_AUTHOR_EMAIL=nunya@bidness.com",
+			"GIT_COMMITTER_NAME=Nunya Bidness",
+			"GIT_COMMITTER_EMAIL=nunya@bidness.com",
+		)
+		output, err := command.CombinedOutput()
+		return string(output), err
+	}
+
+	for _, args := range [][]string{
+		{"init", "--initial-branch=main"},
+		{"commit", "--allow-empty", "-m", "First"},
+	} {
+		output, err := gitCommand(args...)
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, output)
+		}
+	}
+
+	output, err := gitCommand("push", pushURL, "HEAD:main")
+	if err == nil {
+		t.Fatalf("push without permission to create succeeded: %s", output)
+	}
+
+	if _, err := os.Stat(testRepo.FullPath); err == nil {
+		t.Fatal("repository created without permission")
+	}
+
+	err = os.MkdirAll(filepath.Dir(testRepo.OrgConfigPath()), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(testRepo.OrgConfigPath(), []byte("[access \"nunya\"]\n\tcreate = true\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err = gitCommand("push", pushURL, "HEAD:main")
+	if err != nil {
+		t.Fatalf("push to create failed: %s", output)
+	}
+
+	if !strings.Contains(output, "remote: Created repository test_org_create/test_repo_created") || !strings.Contains(output, testRepo.CloneURL) {
+		t.Errorf("push output -> expected the new repository to be announced, got %s", output)
+	}
+
+	level, err := auth.RepositoryAccess(context.Background(), testRepo, &auth.User{Name: testUserName})
+	if err != nil || level != auth.AdminAccess {
+		t.Errorf("creator access -> expected admin, got %v, %v", level, err)
+	}
+
+	output, err = gitCommand("commit", "--allow-empty", "-m", "Second")
+	if err != nil {
+		t.Fatal(output)
+	}
+
+	output, err = gitCommand("push", pushURL, "HEAD:main")
+	if err != nil || strings.Contains(output, "Created repository") {
+		t.Errorf("second push -> expected no announcement, got %v: %s", err, output)
+	}
+
+	abandonedRepo, err := git.NewRemoteRepository(config.Settings.BaseURL, "test_org_create", "test_repo_abandoned")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A push that gives up after the advertisement
+	status, _ := getBody(t, baseURL+"/test_org_create/test_repo_abandoned.git/info/refs?service=git-receive-pack")
+	if status != http.StatusOK {
+		t.Fatalf("advertisement status -> expected %d, got %d", http.StatusOK, status)
+	}
+
+	err = sweepAbandonedRepositories(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, remoteRepo := range []git.GitRemoteRepository{testRepo, abandonedRepo} {
+		if _, err := os.Stat(remoteRepo.FullPath); err != nil {
+			t.Fatalf("%s removed before the timeout: %v", remoteRepo.Name, err)
+		}
+	}
+
+	err = sweepAbandonedRepositories(context.Background(), time.Now().Add(config.Settings.Server.PushToCreateTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(abandonedRepo.FullPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("abandoned repository -> expected it to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(testRepo.FullPath); err != nil {
+		t.Errorf("pushed repository -> expected it to stay, got %v", err)
+	}
+}
+
+func TestServiceTimeout(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "read")
+
+	timeouts := config.Settings.Timeouts
+	defer func() { config.Settings.Timeouts = timeouts }()
+	config.Settings.Timeouts.AdvertiseRefs = time.Nanosecond
+
+	response, err := http.Get(authenticatedURL(t, ts) + "/test_org/test_repo_timeout.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The advertisement has started by the time git runs, so the timeout is
+	// reported in an ERR packet
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status -> expected %d, got %d", http.StatusOK, response.StatusCode)
+	}
+
+	wantBody := "ERR git-upload-pack: service timed out after 1ns"
+	if !strings.Contains(string(body), wantBody) {
+		t.Errorf("body -> expected %q, got %q", wantBody, body)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "write")
+
+	// Another push holds the repository until the request gives up waiting
+	release, err := limit.DefaultServices().Acquire(context.Background(), "git-receive-pack", testRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	response, err := http.Post(authenticatedURL(t, ts)+"/test_org/test_repo_limit.git/git-receive-pack", "application/x-git-receive-pack-request", strings.NewReader("0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status -> expected %d, got %d", http.StatusServiceUnavailable, response.StatusCode)
+	}
+
+	if response.Header.Get("Retry-After") != "10" {
+		t.Errorf("Retry-After -> expected 10, got %q", response.Header.Get("Retry-After"))
+	}
+
+	stats := limit.DefaultServices().Stats()["repositories"]
+	if stats.Rejected == 0 || stats.WaitSeconds == 0 {
+		t.Errorf("repository queue stats -> expected a rejected wait, got %+v", stats)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	gracePeriod := config.Settings.Server.ShutdownGracePeriod
+	defer func() { config.Settings.Server.ShutdownGracePeriod = gracePeriod }()
+
+	testRepo, err := git.NewRemoteRepository("http://localhost", "test_org", "test_repo_shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string // description of this test case
+		gracePeriod time.Duration
+		// How long the running push takes, it stops early when cancelled
+		pushTime      time.Duration
+		wantCancelled bool
+	}{
+		{
+			name:        "push finishing within the grace period",
+			gracePeriod: 5 * time.Second,
+			pushTime:    100 * time.Millisecond,
+		},
+		{
+			name:          "push outlasting the grace period",
+			gracePeriod:   100 * time.Millisecond,
+			pushTime:      time.Minute,
+			wantCancelled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Settings.Server.ShutdownGracePeriod = tt.gracePeriod
+
+			baseContext, cancelServices := context.WithCancelCause(context.Background())
+			server := &http.Server{Handler: GetRouter()}
+
+			release, err := limit.DefaultServices().Acquire(baseContext, "git-receive-pack", testRepo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				select {
+				case <-time.After(tt.pushTime):
+				case <-baseContext.Done():
+				}
+				release()
+			}()
+
+			start := time.Now()
+			shutdown([]*http.Server{server}, nil, cancelServices)
+
+			if busy := limit.DefaultServices().Busy(); len(busy) > 0 {
+				t.Errorf("busy repositories after shutdown -> %v", busy)
+			}
+
+			if cancelled := baseContext.Err() != nil; cancelled != tt.wantCancelled {
+				t.Errorf("services cancelled -> expected %v, got %v", tt.wantCancelled, cancelled)
+			}
+
+			if !tt.wantCancelled && time.Since(start) < tt.pushTime {
+				t.Errorf("shutdown returned after %s, before the push finished", time.Since(start))
+			}
+		})
+	}
+}
+
+// Write a self-signed certificate for 127.0.0.1 named commonName
+func writeTestCertificate(t *testing.T, certPath, keyPath, commonName string) {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certPath, keyPath, "first")
+
+	settings := config.Settings.Server
+	settings.Address = "127.0.0.1:0"
+	settings.SocketPath = filepath.Join(dir, "gitgud.sock")
+	settings.TLS = config.TLSSettings{Address: "127.0.0.1:0", CertPath: certPath, KeyPath: keyPath}
+	settings.HTTP2 = true
+	settings.RedirectHTTP = true
+
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(writer, request.Proto)
+	})
+
+	httpListeners, err := openHTTPListeners(settings, handler, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := map[string]string{}
+	for _, httpListener := range httpListeners {
+		go httpListener.serve()
+		defer httpListener.server.Close()
+
+		name := httpListener.listener.Addr().Network()
+		if httpListener.tls {
+			name = "https"
+		}
+		addresses[name] = httpListener.listener.Addr().String()
+	}
+
+	// Connects over TLS and returns the protocol and certificate name
+	getHTTPS := func() (string, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+
+		response, err := client.Get("https://" + addresses["https"] + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		body, _ := io.ReadAll(response.Body)
+		return string(body), response.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	proto, name := getHTTPS()
+	if proto != "HTTP/2.0" || name != "first" {
+		t.Errorf("https -> expected HTTP/2.0 with certificate first, got %s with %s", proto, name)
+	}
+
+	// A renewed certificate is picked up by the next handshake
+	writeTestCertificate(t, certPath, keyPath, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	os.Chtimes(keyPath, later, later)
+
+	_, name = getHTTPS()
+	if name != "second" {
+		t.Errorf("certificate after renewal -> expected second, got %s", name)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get("http://" + addresses["tcp"] + "/org/repo.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	_, httpsPort, _ := net.SplitHostPort(addresses["https"])
+	wantLocation := "https://127.0.0.1:" + httpsPort + "/org/repo.git/info/refs?service=git-upload-pack"
+	if response.StatusCode != http.StatusPermanentRedirect || response.Header.Get("Location") != wantLocation {
+		t.Errorf("http -> expected redirect to %s, got %d to %s", wantLocation, response.StatusCode, response.Header.Get("Location"))
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", settings.SocketPath)
+		},
+	}}
+	response, err = unixClient.Get("http://gitgud/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("unix socket -> expected HTTP/1.1, got %s", body)
+	}
+}
+
+func TestMountRouter(t *testing.T) {
+	settings := config.Settings.Server
+	settings.BasePath = "/gitgud/"
+	settings.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1", "not a proxy"}
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /{orgName}/{repositoryName}/info/refs", func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(writer, mountURL(request))
+	})
+	handler := mountRouter(router, settings)
+
+	tests := []struct {
+		name       string // description of this test case
+		remoteAddr string
+		path       string
+		header     map[string]string
+		wantStatus int
+		wantURL    string
+	}{
+		{
+			name:       "direct request",
+			remoteAddr: "203.0.113.1:1234",
+			path:       "/gitgud/org/repo.git/info/refs",
+			wantStatus: http.StatusOK,
+			wantURL:    "https://gitgud.com/gitgud",
+		},
+		{
+			name:       "outside the base path",
+			remoteAddr: "203.0.113.1:1234",
+			path:       "/org/repo.git/info/refs",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "forwarded headers from an untrusted client",
+			remoteAddr: "203.0.113.1:1234",
+			path:       "/gitgud/org/repo.git/info/refs",
+			header:     map[string]string{"X-Forwarded-Host": "evil.example.com"},
+			wantStatus: http.StatusOK,
+			wantURL:    "https://gitgud.com/gitgud",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:1234",
+			path:       "/gitgud/org/repo.git/info/refs",
+			header: map[string]string{
+				"X-Forwarded-Proto":  "http, https",
+				"X-Forwarded-Host":   "git.example.com:8080",
+				"X-Forwarded-Prefix": "/code/",
+			},
+			wantStatus: http.StatusOK,
+			wantURL:    "http://git.example.com:8080/code/gitgud",
+		},
+		{
+			name:       "trusted proxy address with invalid values",
+			remoteAddr: "192.168.1.1:1234",
+			path:       "/gitgud/org/repo.git/info/refs",
+			header: map[string]string{
+				"X-Forwarded-Proto":  "gopher",
+				"X-Forwarded-Host":   "user@evil.example.com",
+				"X-Forwarded-Prefix": "relative",
+			},
+			wantStatus: http.StatusOK,
+			wantURL:    "https://gitgud.com/gitgud",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			request.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.header {
+				request.Header.Set(key, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status -> expected %d, got %d", tt.wantStatus, recorder.Code)
+			}
+
+			if tt.wantURL != "" && recorder.Body.String() != tt.wantURL {
+				t.Errorf("mount URL -> expected %s, got %s", tt.wantURL, recorder.Body.String())
+			}
+		})
+	}
+}
+
+// Buffer safe to write from the goroutines of a server
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	var logs syncBuffer
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+	slog.SetDefault(slog.New(logging.NewHandler(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "read")
+
+	response, err := http.Get(authenticatedURL(t, ts) + "/test_org/test_repo_access_log.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	requestID := response.Header.Get("X-Request-Id")
+	if len(requestID) != 32 {
+		t.Fatalf("X-Request-Id -> expected 32 hex digits, got %q", requestID)
+	}
+
+	// The line is logged once the handler returns, which may be after the
+	// client has the whole response
+	var accessLine map[string]any
+	var withID []string
+	for range 100 {
+		withID = nil
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var record map[string]any
+			if json.Unmarshal([]byte(line), &record) != nil || record["request_id"] != requestID {
+				continue
+			}
+
+			withID = append(withID, record["msg"].(string))
+			if record["msg"] == "request" {
+				accessLine = record
+			}
+		}
+
+		if accessLine != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if accessLine == nil {
+		t.Fatalf("no access log line for request %s in:\n%s", requestID, logs.String())
+	}
+
+	for key, want := range map[string]any{
+		"method":     "GET",
+		"path":       "/test_org/test_repo_access_log.git/info/refs",
+		"status":     200.0,
+		"user":       testUserName,
+		"org":        "test_org",
+		"repository": "test_repo_access_log",
+		"service":    "git-upload-pack",
+		"exit_code":  0.0,
+		"bytes_in":   0.0,
+	} {
+		if accessLine[key] != want {
+			t.Errorf("%s -> expected %v, got %v", key, want, accessLine[key])
+		}
+	}
+
+	if bytesOut, _ := accessLine["bytes_out"].(float64); bytesOut == 0 {
+		t.Errorf("bytes_out -> expected the advertisement size, got %v", accessLine["bytes_out"])
+	}
+
+	if !slices.Contains(withID, "calling service") {
+		t.Errorf("logs of the git package -> expected them to carry the request ID, got %v", withID)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(authenticatedURL(t, ts), "test_org", "test_repo_metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	grantTestUser(t, testRepo, "write")
+	pushTestCommit(t, testRepo, map[string]string{"readme.md": "first"})
+
+	clonedRepo, err := testRepo.Clone(context.Background(), "test_repo_metrics_clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clonedRepo.DeleteRepo(context.Background())
+
+	err = os.WriteFile(fmt.Sprintf("%s/second.md", clonedRepo.FullPath), []byte("second"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []func(context.Context) error{
+		clonedRepo.AddAll,
+		func(ctx context.Context) error { return clonedRepo.SetConfig(ctx, "user.name", "Nunya Bidness") },
+		func(ctx context.Context) error { return clonedRepo.SetConfig(ctx, "user.email", "nunya@bidness.com") },
+		func(ctx context.Context) error { return clonedRepo.Commit(ctx, "Second commit") },
+		clonedRepo.Push,
+	} {
+		err = step(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A commit the clone doesn't have yet, for it to fetch
+	pushTestCommit(t, testRepo, map[string]string{"third.md": "third"})
+
+	command, _, stdErr := clonedRepo.Command(context.Background(), "git", "fetch", "origin")
+	command.Dir = clonedRepo.FullPath
+	err = git.Run(command)
+	if err != nil {
+		t.Fatalf("git fetch: %s: %s", err, stdErr)
+	}
+
+	// Metrics name private repositories, they are only on their own listener
+	status, _ := getBody(t, ts.URL+"/metrics")
+	if status != http.StatusNotFound {
+		t.Errorf("/metrics of the router -> expected %d, got %d", http.StatusNotFound, status)
+	}
+
+	metricsListener, err := openMetricsListener("127.0.0.1:0", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go metricsListener.serve()
+	defer metricsListener.server.Close()
+
+	response, err := http.Get("http://" + metricsListener.listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type -> expected the Prometheus text format, got %q", contentType)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(body), "\n")
+
+	for _, want := range []string{
+		`gitgud_git_operations_total{org="test_org",repository="test_repo_metrics",service="git-upload-pack",operation="clone"} 1`,
+		`gitgud_git_operations_total{org="test_org",repository="test_repo_metrics",service="git-upload-pack",operation="fetch"} 1`,
+		`gitgud_git_operations_total{org="test_org",repository="test_repo_metrics",service="git-receive-pack",operation="push"} 1`,
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("expected line %s in:\n%s", want, body)
+		}
+	}
+
+	// Other tests share the registry, only check the series are there
+	for _, prefix := range []string{
+		`gitgud_git_requests_total{service="git-upload-pack",phase="advertisement",result="ok"} `,
+		`gitgud_git_request_duration_seconds_count{service="git-receive-pack",phase="rpc"} `,
+		`gitgud_git_command_duration_seconds_count{command="upload-pack"} `,
+		`gitgud_git_commands_in_flight{command="upload-pack"} `,
+		`gitgud_git_bytes_total{service="git-receive-pack",direction="received"} `,
+		`gitgud_git_bytes_total{service="git-upload-pack",direction="sent"} `,
+		`gitgud_git_services_running{limiter="git-upload-pack"} `,
+		`gitgud_git_services_acquired_total{limiter="git-upload-pack"} `,
+	} {
+		if !slices.ContainsFunc(lines, func(line string) bool { return strings.HasPrefix(line, prefix) }) {
+			t.Errorf("expected a line starting with %s in:\n%s", prefix, body)
+		}
+	}
+}
+
+// Return the status and body of a GET of url
+func getBody(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, string(body)
+}
+
+func TestFetchScanner(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   string
+		response  string
+		wantHaves int
+		wantPack  bool
+	}{
+		{
+			name:      "negotiation round",
+			request:   "0032want 0123456789012345678901234567890123456789\n00000032have 0123456789012345678901234567890123456789\n0000",
+			response:  "0008NAK\n",
+			wantHaves: 1,
+		},
+		{
+			name:     "sideband pack",
+			request:  "0032want 0123456789012345678901234567890123456789\n00000009done\n",
+			response: "0008NAK\n000d\x02progress0009\x01PACK",
+			wantPack: true,
+		},
+		{
+			name:     "pack without sideband",
+			request:  "0032want 0123456789012345678901234567890123456789\n00000009done\n",
+			response: "0008NAK\nPACK\x00\x00\x00\x02",
+			wantPack: true,
+		},
+		{
+			name:     "version 2 packfile",
+			request:  "0012command=fetch\n00010032want 0123456789012345678901234567890123456789\n0009done\n0000",
+			response: "000dpackfile\n0009\x01PACK",
+			wantPack: true,
+		},
+		{
+			name:     "version 2 ls-refs",
+			request:  "0014command=ls-refs\n00010000",
+			response: "003d0123456789012345678901234567890123456789 refs/heads/main\n0000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetch := &fetchScanner{}
+
+			// Written a byte at a time, packets arrive split anywhere
+			for _, pair := range []struct {
+				writer io.Writer
+				data   string
+			}{{fetch.Request(), tt.request}, {fetch.Response(), tt.response}} {
+				for i := range len(pair.data) {
+					pair.writer.Write([]byte{pair.data[i]})
+				}
+			}
+
+			if fetch.haves != tt.wantHaves || fetch.pack != tt.wantPack {
+				t.Errorf("expected %d haves and pack %v, got %d and %v", tt.wantHaves, tt.wantPack, fetch.haves, fetch.pack)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	repositoriesLocation := config.Settings.RepositoriesLocation
+	defer func() {
+		config.Settings.RepositoriesLocation = repositoriesLocation
+		shuttingDown.Store(false)
+	}()
+
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	tests := []struct {
+		name                 string // description of this test case
+		repositoriesLocation string
+		shuttingDown         bool
+		wantStatus           int
+		wantChecks           map[string]string
+	}{
+		{
+			name:                 "ready",
+			repositoriesLocation: repositoriesLocation,
+			wantStatus:           http.StatusOK,
+			wantChecks:           map[string]string{"git": "ok", "repositories": "ok", "lfs": "ok", "webhooks": "ok"},
+		},
+		{
+			name:                 "missing repositories",
+			repositoriesLocation: filepath.Join(t.TempDir(), "missing"),
+			wantStatus:           http.StatusServiceUnavailable,
+			wantChecks:           map[string]string{"git": "ok", "repositories": "failing", "lfs": "ok", "webhooks": "ok"},
+		},
+		{
+			name:                 "shutting down",
+			repositoriesLocation: repositoriesLocation,
+			shuttingDown:         true,
+			wantStatus:           http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Settings.RepositoriesLocation = tt.repositoriesLocation
+			shuttingDown.Store(tt.shuttingDown)
+
+			// Alive no matter what
+			status, body := getBody(t, ts.URL+"/healthz")
+			if status != http.StatusOK || body != "ok\n" {
+				t.Errorf("GET /healthz -> expected 200 ok, got %d %q", status, body)
+			}
+
+			status, body = getBody(t, ts.URL+"/readyz")
+			if status != tt.wantStatus {
+				t.Errorf("GET /readyz -> expected status %d, got %d: %s", tt.wantStatus, status, body)
+			}
+
+			var got readiness
+			err := json.Unmarshal([]byte(body), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotChecks := map[string]string{}
+			for name, result := range got.Checks {
+				gotChecks[name] = result.Status
+			}
+			if len(tt.wantChecks) > 0 && !maps.Equal(gotChecks, tt.wantChecks) {
+				t.Errorf("GET /readyz checks -> expected %v, got %v", tt.wantChecks, got.Checks)
+			}
+			if strings.Contains(body, tt.repositoriesLocation) {
+				t.Errorf("GET /readyz -> expected no paths in the body, got %s", body)
+			}
+			if tt.shuttingDown && got.Status != "shutting down" {
+				t.Errorf("GET /readyz status -> expected shutting down, got %q", got.Status)
+			}
+		})
+	}
+}
+
+func TestHomePage(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	publicRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_home_public")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_home_private")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, remoteRepo := range []git.GitRemoteRepository{publicRepo, privateRepo} {
+		err = remoteRepo.CreateBareRepo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer remoteRepo.DeleteRepo(context.Background())
+	}
+
+	err = publicRepo.SetConfig(context.Background(), "gitgud.anonymousRead", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(publicRepo.FullPath, "description"), []byte("Open to everyone\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestCommit(t, publicRepo, map[string]string{"readme.md": "hello"})
+
+	baseURL := authenticatedURL(t, ts)
+	grantTestUser(t, privateRepo, "read")
+
+	tests := []struct {
+		name       string // description of this test case
+		url        string
+		wantStatus int
+		wantShown  []string
+		wantHidden []string
+	}{
+		{
+			name:       "anonymous home page",
+			url:        ts.URL + "/",
+			wantStatus: http.StatusOK,
+			wantShown: []string{
+				`href="` + config.Settings.MountURL() + `/test_org/test_repo_home_public"`,
+				"Open to everyone",
+				"Updated <time",
+				"just now",
+			},
+			wantHidden: []string{"test_repo_home_private", "Unnamed repository"},
+		},
+		{
+			name:       "home page of a user",
+			url:        baseURL + "/",
+			wantStatus: http.StatusOK,
+			wantShown: []string{
+				"test_repo_home_public",
+				`href="` + config.Settings.MountURL() + `/test_org/test_repo_home_private"`,
+				"No commits yet",
+				testUserName,
+			},
+		},
+		{
+			name:       "org page",
+			url:        baseURL + "/test_org",
+			wantStatus: http.StatusOK,
+			wantShown:  []string{"test_repo_home_public", "test_repo_home_private"},
+		},
+		{
+			name:       "missing org",
+			url:        baseURL + "/test_org_missing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := getBody(t, tt.url)
+			if status != tt.wantStatus {
+				t.Fatalf("GET %s -> expected status %d, got %d: %s", tt.url, tt.wantStatus, status, body)
+			}
+
+			for _, want := range tt.wantShown {
+				if !strings.Contains(body, want) {
+					t.Errorf("GET %s -> expected %q in:\n%s", tt.url, want, body)
+				}
+			}
+
+			for _, hidden := range tt.wantHidden {
+				if strings.Contains(body, hidden) {
+					t.Errorf("GET %s -> expected no %q in:\n%s", tt.url, hidden, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRepositoryPage(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_page")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	baseURL := authenticatedURL(t, ts)
+	grantTestUser(t, testRepo, "read")
+
+	cloneURL := config.Settings.MountURL() + "/test_org/test_repo_page.git"
+
+	status, body := getBody(t, baseURL+"/test_org/test_repo_page")
+	if status != http.StatusOK {
+		t.Fatalf("GET empty repository -> expected status 200, got %d: %s", status, body)
+	}
+	for _, want := range []string{"This repository is empty", "git remote add origin " + cloneURL, "git push -u origin main"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET empty repository -> expected %q in:\n%s", want, body)
+		}
+	}
+
+	pushTestCommit(t, testRepo, map[string]string{"readme.md": "hello", "main.go": "package main"})
+
+	commits, err := testRepo.GetCommits(context.Background(), "main", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string // description of this test case
+		url        string
+		wantStatus int
+		wantShown  []string
+	}{
+		{
+			name:       "overview",
+			url:        baseURL + "/test_org/test_repo_page",
+			wantStatus: http.StatusOK,
+			wantShown: []string{
+				`value="` + cloneURL + `"`,
+				commits[0].ID[:7],
+				"Test commit",
+				"readme.md",
+				"main.go",
+			},
+		},
+		{
+			name:       "overview with .git suffix",
+			url:        baseURL + "/test_org/test_repo_page.git",
+			wantStatus: http.StatusOK,
+			wantShown:  []string{commits[0].ID[:7]},
+		},
+		{
+			name:       "anonymous",
+			url:        ts.URL + "/test_org/test_repo_page",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing repository",
+			url:        baseURL + "/test_org/test_repo_page_missing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := getBody(t, tt.url)
+			if status != tt.wantStatus {
+				t.Fatalf("GET %s -> expected status %d, got %d: %s", tt.url, tt.wantStatus, status, body)
+			}
+
+			for _, want := range tt.wantShown {
+				if !strings.Contains(body, want) {
+					t.Errorf("GET %s -> expected %q in:\n%s", tt.url, want, body)
+				}
+			}
+		})
+	}
+
+	// A detached HEAD has no branch to show, its commit is shown instead
+	command, _, stdErr := testRepo.Command(context.Background(), "git", "update-ref", "--no-deref", "HEAD", commits[0].ID)
+	command.Dir = testRepo.FullPath
+	err = git.Run(command)
+	if err != nil {
+		t.Fatalf("git update-ref: %s: %s", err, stdErr)
+	}
+
+	status, body = getBody(t, baseURL+"/test_org/test_repo_page")
+	if status != http.StatusOK || !strings.Contains(body, commits[0].ID[:7]) {
+		t.Errorf("GET repository with detached HEAD -> expected 200 showing %s, got %d:\n%s", commits[0].ID[:7], status, body)
+	}
+
+	status, body = getBody(t, baseURL+"/")
+	if status != http.StatusOK || !strings.Contains(body, "test_repo_page") {
+		t.Errorf("GET / with a detached HEAD -> expected 200 listing test_repo_page, got %d:\n%s", status, body)
+	}
+}
+
+func TestTreePage(t *testing.T) {
+	ts := httptest.NewServer(GetRouter())
+	defer ts.Close()
+
+	testRepo, err := git.NewRemoteRepository(ts.URL, "test_org", "test_repo_tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	baseURL := authenticatedURL(t, ts)
+	grantTestUser(t, testRepo, "read")
+
+	pushTestCommit(t, testRepo, map[string]string{
+		"a_readme.md":        "hello",
+		"src/a_main.go":      "package main",
+		"src/lib/library.go": "package lib",
+	})
+
+	treeURL := config.Settings.MountURL() + "/test_org/test_repo_tree/tree/main"
+
+	tests := []struct {
+		name       string // description of this test case
+		path       string
+		wantStatus int
+		// In this order
+		wantShown  []string
+		wantHidden []string
+	}{
+		{
+			name:       "root",
+			path:       "/test_org/test_repo_tree/tree/main",
+			wantStatus: http.StatusOK,
+			wantShown: []string{
+				`<span class="font-semibold">test_repo_tree</span>`,
+				`<a href="` + treeURL + `/src" class="hover:underline">src/</a>`,
+				"a_readme.md",
+				"5 B",
+			},
+			wantHidden: []string{">..</a>"},
+		},
+		{
+			name:       "root with trailing slash",
+			path:       "/test_org/test_repo_tree/tree/main/",
+			wantStatus: http.StatusOK,
+			wantShown:  []string{"src/", "a_readme.md"},
+		},
+		{
+			name:       "subdirectory",
+			path:       "/test_org/test_repo_tree/tree/main/src/lib",
+			wantStatus: http.StatusOK,
+			wantShown: []string{
+				`<a href="` + treeURL + `" class="text-blue-600 hover:underline">test_repo_tree</a>`,
+				`<a href="` + treeURL + `/src" class="text-blue-600 hover:underline">src</a>`,
+				`<span class="font-semibold">lib</span>`,
+				`<a href="` + treeURL + `/src" class="flex items-center px-6 py-4 hover:bg-gray-50 transition text-gray-800">..</a>`,
+				"library.go",
+			},
+			wantHidden: []string{"a_main.go", "a_readme.md"},
+		},
+		{
+			name:       "directories first",
+			path:       "/test_org/test_repo_tree/tree/main/src",
+			wantStatus: http.StatusOK,
+			wantShown:  []string{"lib/", "a_main.go"},
+		},
+		{
+			name:       "file instead of directory",
+			path:       "/test_org/test_repo_tree/tree/main/a_readme.md",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "missing ref",
+			path:       "/test_org/test_repo_tree/tree/missing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := getBody(t, baseURL+tt.path)
+			if status != tt.wantStatus {
+				t.Fatalf("GET %s -> expected status %d, got %d: %s", tt.path, tt.wantStatus, status, body)
+			}
+
+			rest := body
+			for _, want := range tt.wantShown {
+				_, after, found := strings.Cut(rest, want)
+				if !found {
+					t.Fatalf("GET %s -> expected %q, after what came before it, in:\n%s", tt.path, want, body)
+				}
+				rest = after
+			}
+
+			for _, hidden := range tt.wantHidden {
+				if strings.Contains(body, hidden) {
+					t.Errorf("GET %s -> expected no %q in:\n%s", tt.path, hidden, body)
+				}
+			}
+		})
+	}
+}
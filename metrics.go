@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"gitgud/git"
+	"gitgud/limit"
+	"gitgud/metrics"
+	"gitgud/pktline"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	gitOperations = metrics.Default.Counter(
+		"gitgud_git_operations_total",
+		"Clones, fetches and pushes served over HTTP, by repository.",
+		"org", "repository", "service", "operation",
+	)
+	gitRequests = metrics.Default.Counter(
+		"gitgud_git_requests_total",
+		"Smart HTTP requests, by service, phase and result.",
+		"service", "phase", "result",
+	)
+	gitRequestDuration = metrics.Default.Histogram(
+		"gitgud_git_request_duration_seconds",
+		"Time smart HTTP requests took to answer, by service and phase.",
+		metrics.DurationBuckets,
+		"service", "phase",
+	)
+	gitBytes = metrics.Default.Counter(
+		"gitgud_git_bytes_total",
+		"Bytes git services received from and sent to clients over HTTP.",
+		"service", "direction",
+	)
+	requestErrors = metrics.Default.Counter(
+		"gitgud_http_errors_total",
+		"Requests answered with an error, by type.",
+		"type",
+	)
+)
+
+// Phases of the smart HTTP protocol, the ref advertisement and the
+// requests running the service
+const (
+	phaseAdvertisement = "advertisement"
+	phaseRPC           = "rpc"
+)
+
+// Record how a git service request went once it returns err
+func observeGitRequest(service, phase string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	gitRequests.Inc(service, phase, result)
+	gitRequestDuration.Observe(time.Since(start).Seconds(), service, phase)
+}
+
+// Count the push of a receive-pack request, or the clone or fetch of an
+// upload-pack request given the haves the request sent and whether the
+// response carried a pack. Fetches negotiating over several requests only
+// get a pack on the last one, requests only listing refs never do.
+func countGitOperation(remoteRepo git.GitRemoteRepository, service string, fetch *fetchScanner) {
+	operation := "push"
+	if service == "git-upload-pack" {
+		if !fetch.pack {
+			return
+		}
+
+		operation = "fetch"
+		if fetch.haves == 0 {
+			operation = "clone"
+		}
+	}
+
+	gitOperations.Inc(remoteRepo.OrgName, remoteRepo.Name, service, operation)
+}
+
+// Scans an upload-pack request for haves and its response for a pack,
+// through the writers teed off either.
+type fetchScanner struct {
+	haves int
+	pack  bool
+}
+
+func (s *fetchScanner) Request() io.Writer {
+	return &packetScanner{packet: func(data []byte) bool {
+		if bytes.HasPrefix(data, []byte("have ")) {
+			s.haves++
+		}
+		return true
+	}}
+}
+
+// The pack follows the packfile section of version 2 responses, and the
+// acknowledgments of older ones on sideband 1 or as is
+func (s *fetchScanner) Response() io.Writer {
+	return &packetScanner{
+		packet: func(data []byte) bool {
+			s.pack = string(data) == "packfile\n" || len(data) > 0 && data[0] == pktline.SidebandData
+			return !s.pack
+		},
+		undecodable: func(rest []byte) {
+			s.pack = bytes.HasPrefix(rest, []byte("PACK"))
+		},
+	}
+}
+
+// Hands the data of every pkt-line written to it to packet until it returns
+// false, holding on to no more than the packet being read. Flush, delim and
+// response-end packets have no data. Whatever follows once the stream turns
+// out not to be pkt-lines goes to undecodable. Writes never fail so it can
+// be teed off a request or response.
+type packetScanner struct {
+	packet      func(data []byte) bool
+	undecodable func(rest []byte)
+
+	pending []byte
+	done    bool
+}
+
+func (s *packetScanner) Write(p []byte) (int, error) {
+	if s.done {
+		return len(p), nil
+	}
+
+	s.pending = append(s.pending, p...)
+	for len(s.pending) >= 4 && !s.done {
+		length, err := strconv.ParseUint(string(s.pending[:4]), 16, 16)
+		if err != nil || length == 3 {
+			if s.undecodable != nil {
+				s.undecodable(s.pending)
+			}
+			s.done = true
+			break
+		}
+
+		if length < 4 {
+			s.pending = s.pending[4:]
+			s.done = !s.packet(nil)
+			continue
+		}
+
+		if len(s.pending) < int(length) {
+			break
+		}
+
+		s.done = !s.packet(s.pending[4:length])
+		s.pending = s.pending[length:]
+	}
+
+	if len(s.pending) == 0 || s.done {
+		s.pending = nil
+	}
+
+	return len(p), nil
+}
+
+// Reader counting the bytes read through it
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// Writer counting the bytes written through it
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// Add the bytes a service exchanged with its client
+func countGitBytes(service string, received *countingReader, sent *countingWriter) {
+	if received != nil {
+		gitBytes.Add(float64(received.count), service, "received")
+	}
+	gitBytes.Add(float64(sent.count), service, "sent")
+}
+
+// Type of an error answered with status, for the metrics
+func errorType(status int, err error) string {
+	switch {
+	case errors.Is(err, limit.ErrBusy):
+		return "busy"
+	case errors.Is(err, git.ErrServiceTimeout):
+		return "timeout"
+	case status == statusClientClosedRequest:
+		return "cancelled"
+	case status == http.StatusBadRequest:
+		return "bad_request"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status >= http.StatusInternalServerError:
+		return "internal"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,331 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets in seconds for the durations of requests and git commands, which
+// range from a config lookup to the clone of a large repository
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Registry of metrics written in the Prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Registry the metrics of gitgud are kept in and served from
+var Default = NewRegistry()
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metric %s registered twice", m.name()))
+		}
+	}
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write every metric, sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	slices.SortFunc(metrics, func(a, b metric) int {
+		return strings.Compare(a.name(), b.name())
+	})
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+
+	return buffered.Flush()
+}
+
+// Serve the registry to Prometheus scrapes
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(writer)
+	})
+}
+
+// Name, help and label names shared by every kind of metric
+type descriptor struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+}
+
+func (d descriptor) name() string {
+	return d.metricName
+}
+
+func (d descriptor) writeHeader(w *bufio.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, help, d.metricName, d.kind)
+}
+
+// Write one sample of the series with labelValues. Histogram buckets pass
+// their le label as bucket.
+func (d descriptor) writeSample(w *bufio.Writer, suffix string, labelValues []string, bucket string, value float64) {
+	w.WriteString(d.metricName + suffix)
+
+	names := d.labels
+	values := labelValues
+	if bucket != "" {
+		names = append(slices.Clone(names), "le")
+		values = append(slices.Clone(values), bucket)
+	}
+
+	if len(names) > 0 {
+		w.WriteString("{")
+		for i, name := range names {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString(name + `="` + escapeLabel(values[i]) + `"`)
+		}
+		w.WriteString("}")
+	}
+
+	w.WriteString(" " + formatValue(value) + "\n")
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Series of a metric kept by their label values
+type series[T any] struct {
+	mu     sync.Mutex
+	values map[string]T
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// Keys of every series, sorted so scrapes list them in a stable order
+func (s *series[T]) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func splitKey(d descriptor, key string) []string {
+	if len(d.labels) == 0 {
+		return nil
+	}
+
+	return strings.Split(key, "\xff")
+}
+
+func (d descriptor) checkLabels(labelValues []string) {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", d.metricName, len(d.labels), len(labelValues)))
+	}
+}
+
+// Value that only goes up, such as a number of requests
+type Counter struct {
+	descriptor
+	series series[float64]
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	counter := &Counter{
+		descriptor: descriptor{metricName: name, help: help, kind: "counter", labels: labels},
+		series:     series[float64]{values: map[string]float64{}},
+	}
+	r.register(counter)
+	return counter
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.checkLabels(labelValues)
+
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	c.series.values[seriesKey(labelValues)] += value
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+
+	c.writeHeader(w)
+	for _, key := range c.series.sortedKeys() {
+		c.writeSample(w, "", splitKey(c.descriptor, key), "", c.series.values[key])
+	}
+}
+
+// Value that goes up and down, such as the number of running processes
+type Gauge struct {
+	Counter
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	gauge := &Gauge{Counter{
+		descriptor: descriptor{metricName: name, help: help, kind: "gauge", labels: labels},
+		series:     series[float64]{values: map[string]float64{}},
+	}}
+	r.register(gauge)
+	return gauge
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.checkLabels(labelValues)
+
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	g.series.values[seriesKey(labelValues)] = value
+}
+
+// Gauges read when scraped from state kept elsewhere. Collect calls emit for
+// every series.
+type GaugeFunc struct {
+	descriptor
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *GaugeFunc {
+	gauge := &GaugeFunc{
+		descriptor: descriptor{metricName: name, help: help, kind: "gauge", labels: labels},
+		collect:    collect,
+	}
+	r.register(gauge)
+	return gauge
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.collect(func(value float64, labelValues ...string) {
+		g.checkLabels(labelValues)
+		g.writeSample(w, "", labelValues, "", value)
+	})
+}
+
+// Counters read when scraped from totals kept elsewhere, see GaugeFunc
+type CounterFunc struct {
+	GaugeFunc
+}
+
+func (r *Registry) CounterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *CounterFunc {
+	counter := &CounterFunc{GaugeFunc{
+		descriptor: descriptor{metricName: name, help: help, kind: "counter", labels: labels},
+		collect:    collect,
+	}}
+	r.register(counter)
+	return counter
+}
+
+// Distribution of observed values, such as durations, counted in buckets
+type Histogram struct {
+	descriptor
+	buckets []float64
+	series  series[*histogramSeries]
+}
+
+type histogramSeries struct {
+	// Observations up to each bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{
+		descriptor: descriptor{metricName: name, help: help, kind: "histogram", labels: labels},
+		buckets:    buckets,
+		series:     series[*histogramSeries]{values: map[string]*histogramSeries{}},
+	}
+	r.register(histogram)
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := h.series.values[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series.values[key] = s
+	}
+
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, key := range h.series.sortedKeys() {
+		labelValues := splitKey(h.descriptor, key)
+		s := h.series.values[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			h.writeSample(w, "_bucket", labelValues, formatValue(bound), float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", labelValues, "+Inf", float64(s.count))
+		h.writeSample(w, "_sum", labelValues, "", s.sum)
+		h.writeSample(w, "_count", labelValues, "", float64(s.count))
+	}
+}
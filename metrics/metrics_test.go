@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.Counter("test_requests_total", "Requests handled.", "service", "status")
+	requests.Inc("git-upload-pack", "200")
+	requests.Add(2, "git-receive-pack", "500")
+	requests.Inc("git-upload-pack", "200")
+
+	running := registry.Gauge("test_running", "Running processes,\nby nothing.")
+	running.Inc()
+	running.Inc()
+	running.Dec()
+
+	registry.GaugeFunc("test_queued", "Queued requests.", []string{"limiter"}, func(emit func(float64, ...string)) {
+		emit(3, `quoted "name"`)
+	})
+
+	durations := registry.Histogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, "command")
+	durations.Observe(0.05, "config")
+	durations.Observe(0.1, "config")
+	durations.Observe(5, "config")
+
+	var output bytes.Buffer
+	err := registry.Write(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{command="config",le="0.1"} 2
+test_duration_seconds_bucket{command="config",le="1"} 2
+test_duration_seconds_bucket{command="config",le="+Inf"} 3
+test_duration_seconds_sum{command="config"} 5.15
+test_duration_seconds_count{command="config"} 3
+# HELP test_queued Queued requests.
+# TYPE test_queued gauge
+test_queued{limiter="quoted \"name\""} 3
+# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{service="git-receive-pack",status="500"} 2
+test_requests_total{service="git-upload-pack",status="200"} 2
+# HELP test_running Running processes,\nby nothing.
+# TYPE test_running gauge
+test_running 1
+`
+	if output.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", output.String(), want)
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("test_total", "Things.").Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := recorder.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %s", got)
+	}
+
+	if !bytes.Contains(recorder.Body.Bytes(), []byte("test_total 1\n")) {
+		t.Errorf("body = %s", recorder.Body.String())
+	}
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("test_total", "Things.")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice didn't panic")
+		}
+	}()
+	registry.Gauge("test_total", "Other things.")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/git"
+	"net/http"
+	"strings"
+)
+
+// Stores the credentials of a request are checked against
+type authenticator struct {
+	users  *auth.UserStore
+	tokens *auth.TokenStore
+}
+
+// Work out who is making the request from a Bearer token or HTTP Basic
+// credentials, where the password may also be a personal access token. The
+// returned level caps what the credentials may do, tokens are capped by their
+// scopes. Anonymous requests return a nil user.
+func (a authenticator) authenticate(request *http.Request) (*auth.User, auth.AccessLevel, error) {
+	if secret, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); found {
+		return a.authenticateToken(secret)
+	}
+
+	name, password, hasCredentials := request.BasicAuth()
+	if !hasCredentials {
+		return nil, auth.AdminAccess, nil
+	}
+
+	// Tokens identify their user, so any user name is accepted with one
+	if auth.IsToken(password) {
+		return a.authenticateToken(password)
+	}
+
+	user, err := a.users.Authenticate(name, password)
+	if err != nil {
+		return nil, auth.NoAccess, err
+	}
+
+	return &user, auth.AdminAccess, nil
+}
+
+func (a authenticator) authenticateToken(secret string) (*auth.User, auth.AccessLevel, error) {
+	token, err := a.tokens.Authenticate(secret)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return nil, auth.NoAccess, auth.ErrInvalidCredentials
+	}
+
+	if err != nil {
+		return nil, auth.NoAccess, err
+	}
+
+	// Tokens die with their user
+	user, err := a.users.Lookup(token.User)
+	if err != nil {
+		return nil, auth.NoAccess, err
+	}
+
+	return &user, token.MaxLevel(), nil
+}
+
+// Authenticate the request and check the user's access to the repository.
+// Pushes need write access, everything else needs minimum.
+func (a authenticator) requireAccess(minimum auth.AccessLevel, next errorHandler) errorHandler {
+	return a.identify(checkAccess(minimum, next))
+}
+
+// Check the access of the client of a request passed through identify to the
+// repository, the access level of the request becomes what it may do there.
+func checkAccess(minimum auth.AccessLevel, next errorHandler) errorHandler {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		user := requestUser(request)
+		limit := auth.AccessLevelFromContext(request.Context())
+
+		required := minimum
+		if requestedService(request) == "git-receive-pack" {
+			required = max(required, auth.WriteAccess)
+		}
+
+		remoteRepo, err := remoteRepositoryFromRequest(request)
+		if err != nil {
+			return err
+		}
+
+		level, err := auth.RepositoryAccess(request.Context(), remoteRepo, user)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case min(level, limit) >= required:
+			request = request.WithContext(auth.WithAccessLevel(request.Context(), min(level, limit)))
+			return next(writer, request)
+		case user == nil:
+			// Anonymous clients get to retry with credentials
+			challenge(writer)
+		case level == auth.NoAccess:
+			// Same answer as a missing repository
+			http.Error(writer, "Repository not found.", http.StatusNotFound)
+		case level >= required:
+			http.Error(writer, fmt.Sprintf("Token of %s lacks the scope needed for %s/%s.", user.Name, remoteRepo.OrgName, remoteRepo.Name), http.StatusForbidden)
+		default:
+			http.Error(writer, fmt.Sprintf("Permission to %s/%s denied to %s.", remoteRepo.OrgName, remoteRepo.Name, user.Name), http.StatusForbidden)
+		}
+
+		return nil
+	}
+}
+
+// Authenticate the request when it carries credentials, for pages anonymous
+// visitors may see too. The access level of the request is the most the
+// credentials may do, repositories are checked one by one with canRead.
+func (a authenticator) identify(next errorHandler) errorHandler {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		user, limit, err := a.authenticate(request)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			challenge(writer)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ctx := auth.WithAccessLevel(request.Context(), limit)
+		if user != nil {
+			ctx = auth.WithUser(ctx, *user)
+			accessEntryFromRequest(request).user = user.Name
+		}
+
+		return next(writer, request.WithContext(ctx))
+	}
+}
+
+// User a request passed through identify was authenticated as, nil for
+// anonymous requests
+func requestUser(request *http.Request) *auth.User {
+	user, ok := auth.UserFromContext(request.Context())
+	if !ok {
+		return nil
+	}
+
+	return &user
+}
+
+// Whether the client of a request passed through identify may read the
+// repository
+func canRead(request *http.Request, remoteRepo git.GitRemoteRepository) (bool, error) {
+	level, err := auth.RepositoryAccess(request.Context(), remoteRepo, requestUser(request))
+	if err != nil {
+		return false, err
+	}
+
+	return min(level, auth.AccessLevelFromContext(request.Context())) >= auth.ReadAccess, nil
+}
+
+// Cache-Control of contents of the repository that never change. Shared
+// caches may only keep those anonymous clients may read.
+func immutableCacheControl(ctx context.Context, remoteRepo git.GitRemoteRepository) (string, error) {
+	level, err := auth.RepositoryAccess(ctx, remoteRepo, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if level >= auth.ReadAccess {
+		return "public, max-age=31536000, immutable", nil
+	}
+
+	return "private, max-age=31536000, immutable", nil
+}
+
+// Ask for credentials, git's credential helpers prompt on this response
+func challenge(writer http.ResponseWriter) {
+	writer.Header().Set("WWW-Authenticate", `Basic realm="gitgud", charset="UTF-8"`)
+	http.Error(writer, "authentication required", http.StatusUnauthorized)
+}
+
+// Return the git service a request is for, from either the service query
+// parameter of info/refs or the path of the service POST
+func requestedService(request *http.Request) string {
+	if service := request.PathValue("service"); service != "" {
+		return service
+	}
+
+	return request.URL.Query().Get("service")
+}
@@ -0,0 +1,61 @@
+// Package netserver accepts the connections of the servers for protocols
+// that don't run over HTTP.
+package netserver
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Serves each connection of a listener in its own goroutine, embedded by the
+// ssh and git daemon servers.
+type Server struct {
+	// Services are cancelled once it is done, the background context when
+	// nil
+	BaseContext context.Context
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// Accept connections until the listener is closed, handling each in its own
+// goroutine
+func (s *Server) Serve(listener net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go handle(conn)
+	}
+}
+
+// Stop accepting connections, services already running carry on until they
+// are done or BaseContext is
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+// Context services run in
+func (s *Server) Context() context.Context {
+	if s.BaseContext == nil {
+		return context.Background()
+	}
+
+	return s.BaseContext
+}
@@ -0,0 +1,45 @@
+package netserver
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server Server
+	handled := make(chan struct{})
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(listener, func(conn net.Conn) {
+			conn.Close()
+			close(handled)
+		})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-handled
+
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-served
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve() after Close() error = %v, want net.ErrClosed", err)
+	}
+
+	if server.Context() == nil {
+		t.Error("Context() without BaseContext = nil, want the background context")
+	}
+}
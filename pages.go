@@ -0,0 +1,362 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/config"
+	"gitgud/git"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Fields every page needs to render base.html
+type page struct {
+	// URL the routes are reachable at, links are built from it
+	BaseURL string
+
+	// Name of the signed in user, empty for anonymous visitors
+	UserName string
+}
+
+func newPage(request *http.Request) page {
+	user, _ := auth.UserFromContext(request.Context())
+	return page{BaseURL: mountURL(request), UserName: user.Name}
+}
+
+// Repository as listed on the home and org pages
+type repositorySummary struct {
+	Name          string
+	Org           string
+	Description   string
+	DefaultBranch string
+
+	// Zero for repositories without commits
+	Updated time.Time
+}
+
+type homePage struct {
+	page
+
+	// Org whose repositories are listed, empty on the home page
+	Org string
+
+	// Most recently updated first
+	Repositories []repositorySummary
+}
+
+// List the repositories of orgName the client of request may read, every
+// org's when it is empty
+func readableRepositories(request *http.Request, orgName string) ([]repositorySummary, error) {
+	remoteRepos, err := git.ListRemoteRepositories(mountURL(request), orgName)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []repositorySummary{}
+	for _, remoteRepo := range remoteRepos {
+		readable, err := canRead(request, remoteRepo)
+		if err != nil {
+			return nil, err
+		}
+		if !readable {
+			continue
+		}
+
+		summary, err := summarizeRepository(request.Context(), remoteRepo)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	slices.SortStableFunc(summaries, func(a, b repositorySummary) int {
+		return cmp.Or(b.Updated.Compare(a.Updated), cmp.Compare(a.Org, b.Org), cmp.Compare(a.Name, b.Name))
+	})
+
+	return summaries, nil
+}
+
+// Branch HEAD points at, HEAD itself when it is detached
+func headBranch(ctx context.Context, remoteRepo git.GitRemoteRepository) (string, error) {
+	branch, err := remoteRepo.GetBranch(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if branch == "" {
+		return "HEAD", nil
+	}
+
+	return branch, nil
+}
+
+func summarizeRepository(ctx context.Context, remoteRepo git.GitRemoteRepository) (repositorySummary, error) {
+	description, err := remoteRepo.Description()
+	if err != nil {
+		return repositorySummary{}, err
+	}
+
+	defaultBranch, err := headBranch(ctx, remoteRepo)
+	if err != nil {
+		return repositorySummary{}, err
+	}
+
+	updated, err := remoteRepo.LastUpdated(ctx)
+	if err != nil {
+		return repositorySummary{}, err
+	}
+
+	return repositorySummary{
+		Name:          remoteRepo.Name,
+		Org:           remoteRepo.OrgName,
+		Description:   description,
+		DefaultBranch: defaultBranch,
+		Updated:       updated,
+	}, nil
+}
+
+// List every repository the client may read
+func HomeHandler(writer http.ResponseWriter, request *http.Request) error {
+	repositories, err := readableRepositories(request, "")
+	if err != nil {
+		return err
+	}
+
+	return RenderNamedAppTemplate(writer, request, "home.html", "base", homePage{
+		page:         newPage(request),
+		Repositories: repositories,
+	})
+}
+
+// List the repositories of an org the client may read
+func OrgHandler(writer http.ResponseWriter, request *http.Request) error {
+	orgName := request.PathValue("orgName")
+
+	// Validated the way repository paths are
+	_, err := git.NewRemoteRepository(mountURL(request), orgName, "repository")
+	if err != nil {
+		return notFound(fmt.Sprintf("org %s not found", orgName))
+	}
+
+	info, err := os.Stat(filepath.Join(config.Settings.RepositoriesLocation, orgName))
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.IsDir() {
+		return notFound(fmt.Sprintf("org %s not found", orgName))
+	}
+	if err != nil {
+		return err
+	}
+
+	repositories, err := readableRepositories(request, orgName)
+	if err != nil {
+		return err
+	}
+
+	return RenderNamedAppTemplate(writer, request, "home.html", "base", homePage{
+		page:         newPage(request),
+		Org:          orgName,
+		Repositories: repositories,
+	})
+}
+
+type repositoryPage struct {
+	page
+
+	Name          string
+	Org           string
+	Description   string
+	DefaultBranch string
+	CloneURL      string
+
+	// Nothing was pushed to the default branch yet, there is no commit or
+	// file to show
+	Empty bool
+
+	LatestCommit        git.Commit
+	LatestCommitShortID string
+	LatestCommitSubject string
+	Files               []git.File
+
+	// Root directory of the default branch
+	TreeURL string
+}
+
+// Length commit IDs are shortened to, as git does by default
+const shortIDLength = 7
+
+// Let pages address repositories without the .git suffix git clients use
+func repositoryPath(next errorHandler) errorHandler {
+	return func(writer http.ResponseWriter, request *http.Request) error {
+		repositoryName := request.PathValue("repositoryName")
+		if !strings.HasSuffix(repositoryName, ".git") {
+			request.SetPathValue("repositoryName", repositoryName+".git")
+		}
+
+		return next(writer, request)
+	}
+}
+
+// Overview of a repository: its latest commit, clone URL and files on the
+// default branch. Empty repositories get instructions for the first push.
+func RepositoryHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	view := repositoryPage{
+		page:     newPage(request),
+		Name:     remoteRepo.Name,
+		Org:      remoteRepo.OrgName,
+		CloneURL: remoteRepo.CloneURL,
+	}
+
+	view.Description, err = remoteRepo.Description()
+	if err != nil {
+		return err
+	}
+
+	view.DefaultBranch, err = headBranch(request.Context(), remoteRepo)
+	if err != nil {
+		return err
+	}
+
+	view.Files, err = remoteRepo.GetFiles(request.Context(), view.DefaultBranch)
+	if errors.As(err, &git.EmptyRepositoryError{}) {
+		view.Empty = true
+		return RenderNamedAppTemplate(writer, request, "repository.html", "base", view)
+	}
+	if err != nil {
+		return err
+	}
+
+	commits, err := remoteRepo.GetCommits(request.Context(), view.DefaultBranch, nil, 1)
+	if err != nil {
+		return err
+	}
+	if len(commits) > 0 {
+		view.LatestCommit = commits[0]
+		view.LatestCommitShortID = commits[0].ID[:min(shortIDLength, len(commits[0].ID))]
+		view.LatestCommitSubject, _, _ = strings.Cut(commits[0].Message, "\n")
+	}
+	view.TreeURL = treeURL(view.BaseURL, view.Org, view.Name, view.DefaultBranch, "")
+
+	return RenderNamedAppTemplate(writer, request, "repository.html", "base", view)
+}
+
+// Link of a tree page, a breadcrumb leading back up or an entry
+type treeLink struct {
+	Name string
+	URL  string
+}
+
+type treeEntryView struct {
+	git.TreeEntry
+
+	// Page of the entry, empty for entries without one
+	URL string
+}
+
+type treePage struct {
+	page
+
+	Name string
+	Org  string
+	Ref  string
+
+	// Directory shown, empty for the root
+	Path string
+
+	// From the repository down to the directory shown, which isn't linked
+	Breadcrumbs []treeLink
+
+	// Empty at the root
+	ParentURL string
+
+	// Directories first
+	Entries []treeEntryView
+}
+
+// URL of the tree page of path at ref, escaped segment by segment
+func treeURL(baseURL, orgName, repoName, ref, path string) string {
+	link := fmt.Sprintf("%s/%s/%s/tree/%s", baseURL, orgName, repoName, url.PathEscape(ref))
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			link += "/" + url.PathEscape(segment)
+		}
+	}
+
+	return link
+}
+
+// Entries of a directory in the tree of a ref, with breadcrumbs leading back
+// up to the root
+func TreeHandler(writer http.ResponseWriter, request *http.Request) error {
+	remoteRepo, err := remoteRepositoryFromRequest(request)
+	if err != nil {
+		return err
+	}
+
+	ref := request.PathValue("ref")
+	path := strings.Trim(request.PathValue("path"), "/")
+
+	entries, err := remoteRepo.GetTree(request.Context(), ref, path)
+	if errors.As(err, &git.TreeNotFoundError{}) {
+		return notFound(err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	view := treePage{
+		page: newPage(request),
+		Name: remoteRepo.Name,
+		Org:  remoteRepo.OrgName,
+		Ref:  ref,
+		Path: path,
+	}
+
+	link := func(path string) string {
+		return treeURL(view.BaseURL, view.Org, view.Name, ref, path)
+	}
+
+	view.Breadcrumbs = []treeLink{{Name: view.Name, URL: link("")}}
+	if path != "" {
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			view.Breadcrumbs = append(view.Breadcrumbs, treeLink{Name: segment, URL: link(strings.Join(segments[:i+1], "/"))})
+		}
+
+		view.ParentURL = link(strings.Join(segments[:len(segments)-1], "/"))
+	}
+	view.Breadcrumbs[len(view.Breadcrumbs)-1].URL = ""
+
+	// Entries come sorted by name, which directories keep among themselves
+	isFile := func(entry git.TreeEntry) int {
+		if entry.Type == git.TreeEntryTree {
+			return 0
+		}
+		return 1
+	}
+	slices.SortStableFunc(entries, func(a, b git.TreeEntry) int {
+		return cmp.Compare(isFile(a), isFile(b))
+	})
+
+	for _, entry := range entries {
+		entryView := treeEntryView{TreeEntry: entry}
+		if entry.Type == git.TreeEntryTree {
+			entryView.URL = link(entry.Path)
+		}
+		view.Entries = append(view.Entries, entryView)
+	}
+
+	return RenderNamedAppTemplate(writer, request, "tree.html", "base", view)
+}
@@ -2,18 +2,65 @@ package main
 
 import (
 	// "gitgud/assert"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"time"
 )
 
 var templateFiles = []string{
 	"base.html",
 	"home.html",
 	"repository.html",
+	"tree.html",
 }
 
-var funcMap = template.FuncMap{}
+var funcMap = template.FuncMap{
+	"timeAgo":  timeAgo,
+	"byteSize": byteSize,
+}
+
+// Size in bytes for people, e.g. "1.5 KB"
+func byteSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 3 {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, []string{"B", "KB", "MB", "GB"}[unit])
+}
+
+// How long ago t was, roughly, e.g. "3 days ago"
+func timeAgo(t time.Time) string {
+	elapsed := time.Since(t)
+
+	plural := func(count int, unit string) string {
+		if count == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", count, unit)
+	}
+
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return plural(int(elapsed.Minutes()), "minute")
+	case elapsed < 24*time.Hour:
+		return plural(int(elapsed.Hours()), "hour")
+	case elapsed < 30*24*time.Hour:
+		return plural(int(elapsed.Hours()/24), "day")
+	default:
+		return "on " + t.Format("Jan 2, 2006")
+	}
+}
 
 var AppTemplates map[string]*template.Template
 
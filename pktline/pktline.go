@@ -0,0 +1,225 @@
+// Package pktline reads and writes the pkt-line framing of the git wire
+// protocol, see gitprotocol-common(5) and gitprotocol-v2(5).
+//
+// Every packet starts with its length, including the 4 length bytes, as 4 hex
+// digits. Lengths 0000, 0001 and 0002 are special packets without data.
+package pktline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// Largest packet, length included
+	MaxPacketSize = 65520
+
+	// Most data a single packet carries
+	MaxDataSize = MaxPacketSize - 4
+
+	lengthSize = 4
+)
+
+type PacketType int
+
+const (
+	Data PacketType = iota
+	// End of a message, 0000
+	Flush
+	// Separates the sections of a version 2 message, 0001
+	Delim
+	// End of a version 2 response for stateless connections, 0002
+	ResponseEnd
+)
+
+func (t PacketType) String() string {
+	switch t {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	default:
+		return fmt.Sprintf("PacketType(%d)", int(t))
+	}
+}
+
+// Sideband channels multiplexed into the packets of a fetch response when
+// side-band or side-band-64k is negotiated
+const (
+	SidebandData     byte = 1
+	SidebandProgress byte = 2
+	SidebandError    byte = 3
+)
+
+var (
+	ErrInvalidLength = errors.New("invalid pkt-line length")
+	ErrTooLong       = errors.New("pkt-line data too long")
+)
+
+type Packet struct {
+	Type PacketType
+	Data []byte
+}
+
+// Return the message of an ERR packet, false for any other packet
+func (p Packet) ErrorMessage() (string, bool) {
+	if p.Type != Data || len(p.Data) < 4 || string(p.Data[:4]) != "ERR " {
+		return "", false
+	}
+
+	return string(p.Data[4:]), true
+}
+
+// Split a sideband packet into its channel and payload, false for packets
+// without a channel
+func (p Packet) Sideband() (byte, []byte, bool) {
+	if p.Type != Data || len(p.Data) == 0 {
+		return 0, nil, false
+	}
+
+	return p.Data[0], p.Data[1:], true
+}
+
+// Streaming pkt-line reader. It never reads past the end of the current
+// packet, whatever follows is left in the underlying reader.
+type Reader struct {
+	reader io.Reader
+	length [lengthSize]byte
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: reader}
+}
+
+// Read the next packet, a clean end of input returns io.EOF.
+func (r *Reader) ReadPacket() (Packet, error) {
+	_, err := io.ReadFull(r.reader, r.length[:])
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Packet{}, fmt.Errorf("%w: truncated length", ErrInvalidLength)
+		}
+		return Packet{}, err
+	}
+
+	length, err := parseLength(r.length[:])
+	if err != nil {
+		return Packet{}, err
+	}
+
+	switch length {
+	case 0:
+		return Packet{Type: Flush}, nil
+	case 1:
+		return Packet{Type: Delim}, nil
+	case 2:
+		return Packet{Type: ResponseEnd}, nil
+	case 3:
+		return Packet{}, fmt.Errorf("%w %q", ErrInvalidLength, r.length[:])
+	}
+
+	data := make([]byte, length-lengthSize)
+	_, err = io.ReadFull(r.reader, data)
+	if err != nil {
+		return Packet{}, fmt.Errorf("failed to read pkt-line data: %w", err)
+	}
+
+	return Packet{Type: Data, Data: data}, nil
+}
+
+func parseLength(hex []byte) (int, error) {
+	// ParseUint also accepts prefixes and underscores, which aren't lengths
+	for _, c := range hex {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return 0, fmt.Errorf("%w %q", ErrInvalidLength, hex)
+		}
+	}
+
+	length, err := strconv.ParseUint(string(hex), 16, 16)
+	if err != nil || length > MaxPacketSize {
+		return 0, fmt.Errorf("%w %q", ErrInvalidLength, hex)
+	}
+
+	return int(length), nil
+}
+
+// Streaming pkt-line writer, every call writes whole packets.
+type Writer struct {
+	writer io.Writer
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer}
+}
+
+func (w *Writer) WritePacket(data []byte) error {
+	if len(data) > MaxDataSize {
+		return ErrTooLong
+	}
+
+	packet := make([]byte, lengthSize+len(data))
+	copy(packet, fmt.Sprintf("%04x", len(packet)))
+	copy(packet[lengthSize:], data)
+
+	_, err := w.writer.Write(packet)
+	return err
+}
+
+func (w *Writer) WriteString(data string) error {
+	return w.WritePacket([]byte(data))
+}
+
+func (w *Writer) WriteFlush() error {
+	_, err := io.WriteString(w.writer, "0000")
+	return err
+}
+
+func (w *Writer) WriteDelim() error {
+	_, err := io.WriteString(w.writer, "0001")
+	return err
+}
+
+func (w *Writer) WriteResponseEnd() error {
+	_, err := io.WriteString(w.writer, "0002")
+	return err
+}
+
+// Write an ERR packet, git aborts and shows the message as a remote error
+func (w *Writer) WriteError(message string) error {
+	return w.WriteString("ERR " + message)
+}
+
+// Return a writer that sends everything written to it on the sideband
+// channel, split into as many packets as it takes. Progress and error
+// messages should end in a newline or carriage return for the client to
+// show them.
+func (w *Writer) Sideband(channel byte) io.Writer {
+	return sidebandWriter{writer: w, channel: channel}
+}
+
+type sidebandWriter struct {
+	writer  *Writer
+	channel byte
+}
+
+func (s sidebandWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), MaxDataSize-1)]
+
+		err := s.writer.WritePacket(append([]byte{s.channel}, chunk...))
+		if err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,284 @@
+package pktline
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReader_ReadPacket(t *testing.T) {
+	tests := []struct {
+		name    string // description of this test case
+		input   string
+		want    []Packet
+		wantErr error
+	}{
+		{
+			name:  "advertisement",
+			input: "001e# service=git-upload-pack\n0000",
+			want: []Packet{
+				{Type: Data, Data: []byte("# service=git-upload-pack\n")},
+				{Type: Flush},
+			},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "special packets",
+			input:   "000100020000",
+			want:    []Packet{{Type: Delim}, {Type: ResponseEnd}, {Type: Flush}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "empty data packet",
+			input:   "0004",
+			want:    []Packet{{Type: Data, Data: []byte{}}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "reserved length",
+			input:   "0003",
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "length is not hex",
+			input:   "00zz",
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "length with a sign",
+			input:   "+00a",
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "length over the maximum",
+			input:   "fff1",
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "truncated length",
+			input:   "00",
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "truncated data",
+			input:   "000ahi",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewReader(strings.NewReader(tt.input))
+
+			got := []Packet{}
+			var err error
+			for {
+				var packet Packet
+				packet, err = reader.ReadPacket()
+				if err != nil {
+					break
+				}
+				got = append(got, packet)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadPacket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadPacket() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReader_LeavesRemainder(t *testing.T) {
+	input := strings.NewReader("0009hello0000PACK")
+
+	reader := NewReader(input)
+	for range 2 {
+		_, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remainder, _ := io.ReadAll(input)
+	if string(remainder) != "PACK" {
+		t.Errorf("remainder = %q, want PACK", remainder)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var output bytes.Buffer
+	writer := NewWriter(&output)
+
+	writer.WriteString("# service=git-upload-pack\n")
+	writer.WriteFlush()
+	writer.WriteDelim()
+	writer.WriteResponseEnd()
+	writer.WriteError("access denied")
+
+	want := "001e# service=git-upload-pack\n000000010002" + "0015ERR access denied"
+	if output.String() != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+
+	err := writer.WritePacket(make([]byte, MaxDataSize+1))
+	if !errors.Is(err, ErrTooLong) {
+		t.Errorf("WritePacket() of too much data = %v, want ErrTooLong", err)
+	}
+
+	packet, err := NewReader(strings.NewReader("0015ERR access denied")).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message, ok := packet.ErrorMessage(); !ok || message != "access denied" {
+		t.Errorf("ErrorMessage() = %q, %v, want access denied", message, ok)
+	}
+}
+
+func TestWriter_Sideband(t *testing.T) {
+	var output bytes.Buffer
+	writer := NewWriter(&output)
+
+	message := strings.Repeat("x", MaxDataSize+10)
+	n, err := writer.Sideband(SidebandProgress).Write([]byte(message))
+	if err != nil || n != len(message) {
+		t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(message))
+	}
+
+	reader := NewReader(&output)
+	var received []byte
+	packets := 0
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channel, payload, ok := packet.Sideband()
+		if !ok || channel != SidebandProgress {
+			t.Fatalf("Sideband() = %d, %v, want channel %d", channel, ok, SidebandProgress)
+		}
+
+		received = append(received, payload...)
+		packets++
+	}
+
+	if packets != 2 || string(received) != message {
+		t.Errorf("received %d bytes in %d packets, want %d bytes in 2", len(received), packets, len(message))
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add([]byte("001e# service=git-upload-pack\n0000"))
+	f.Add([]byte("000100020000"))
+	f.Add([]byte("0015ERR access denied"))
+	f.Add([]byte("0003"))
+	f.Add([]byte("fff1"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		readAll := func(input []byte) []Packet {
+			packets := []Packet{}
+			reader := NewReader(bytes.NewReader(input))
+			for {
+				packet, err := reader.ReadPacket()
+				if err != nil {
+					return packets
+				}
+				packets = append(packets, packet)
+			}
+		}
+
+		// Whatever was read must encode to input that reads the same
+		packets := readAll(input)
+
+		var encoded bytes.Buffer
+		writer := NewWriter(&encoded)
+		for _, packet := range packets {
+			var err error
+			switch packet.Type {
+			case Data:
+				err = writer.WritePacket(packet.Data)
+			case Flush:
+				err = writer.WriteFlush()
+			case Delim:
+				err = writer.WriteDelim()
+			case ResponseEnd:
+				err = writer.WriteResponseEnd()
+			}
+			if err != nil {
+				t.Fatalf("failed to write back %+v: %v", packet, err)
+			}
+		}
+
+		if reread := readAll(encoded.Bytes()); !reflect.DeepEqual(reread, packets) {
+			t.Errorf("read back %+v, want %+v", reread, packets)
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("hello\n"), byte(0))
+	f.Add([]byte{}, byte(2))
+	f.Add([]byte("ERR nope"), byte(3))
+
+	f.Fuzz(func(t *testing.T, data []byte, channel byte) {
+		var output bytes.Buffer
+		writer := NewWriter(&output)
+
+		err := writer.WritePacket(data)
+		if len(data) > MaxDataSize {
+			if !errors.Is(err, ErrTooLong) {
+				t.Fatalf("WritePacket() of %d bytes = %v, want ErrTooLong", len(data), err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = writer.Sideband(channel).Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader := NewReader(&output)
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if packet.Type != Data || !bytes.Equal(packet.Data, data) {
+			t.Errorf("read %+v, want data %q", packet, data)
+		}
+
+		var sideband []byte
+		for {
+			packet, err := reader.ReadPacket()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotChannel, payload, ok := packet.Sideband()
+			if !ok || gotChannel != channel {
+				t.Fatalf("Sideband() = %d, %v, want channel %d", gotChannel, ok, channel)
+			}
+			sideband = append(sideband, payload...)
+		}
+
+		if !bytes.Equal(sideband, data) {
+			t.Errorf("sideband payload %q, want %q", sideband, data)
+		}
+	})
+}
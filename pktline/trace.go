@@ -0,0 +1,206 @@
+package pktline
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+// Wants logged by name, the rest are only counted
+const maxTracedWants = 10
+
+// Tracer decodes a pkt-line stream written to it, as sent by either side of
+// a fetch or push, and logs a summary of the exchange when closed. Pack data
+// is counted rather than decoded, whether sent raw or on sideband 1.
+//
+// Writes never fail so a tracer can be teed off a live stream.
+type Tracer struct {
+	logger *slog.Logger
+
+	// Part of a packet still waiting on the rest of it
+	pending []byte
+
+	// Everything after a raw PACK header is pack data
+	rawPack bool
+
+	// Data packets carry a sideband channel once the pack starts
+	sideband bool
+
+	// Packets following a version 2 capability advertisement up to the next
+	// flush are capabilities
+	advertisingCapabilities bool
+
+	packets      int
+	refs         int
+	capabilities []string
+	commands     []string
+	wants        int
+	wantIDs      []string
+	haves        int
+	updates      []string
+	errors       []string
+	progress     int
+	packBytes    int
+}
+
+func NewTracer(logger *slog.Logger) *Tracer {
+	return &Tracer{logger: logger}
+}
+
+func (t *Tracer) Write(p []byte) (int, error) {
+	if t.rawPack {
+		t.packBytes += len(p)
+		return len(p), nil
+	}
+
+	t.pending = append(t.pending, p...)
+
+	for len(t.pending) >= lengthSize {
+		if string(t.pending[:lengthSize]) == "PACK" {
+			t.rawPack = true
+			t.packBytes += len(t.pending)
+			t.pending = nil
+			break
+		}
+
+		length, err := parseLength(t.pending[:lengthSize])
+		if err != nil || length == 3 {
+			// Not pkt-lines, there is nothing more to decode
+			t.errors = append(t.errors, "undecodable stream")
+			t.rawPack = true
+			t.pending = nil
+			break
+		}
+
+		if length < lengthSize {
+			// Flush, delim and response-end packets
+			t.packets++
+			if length == 0 {
+				t.advertisingCapabilities = false
+			}
+			t.pending = t.pending[lengthSize:]
+			continue
+		}
+
+		if len(t.pending) < length {
+			break
+		}
+
+		t.data(t.pending[lengthSize:length])
+		t.pending = t.pending[length:]
+	}
+
+	// Don't hold on to the memory of every packet ever written
+	if len(t.pending) == 0 {
+		t.pending = nil
+	}
+
+	return len(p), nil
+}
+
+func (t *Tracer) data(data []byte) {
+	t.packets++
+
+	if t.sideband && len(data) > 0 {
+		switch data[0] {
+		case SidebandData:
+			t.packBytes += len(data) - 1
+			return
+		case SidebandProgress:
+			t.progress++
+			return
+		case SidebandError:
+			t.errors = append(t.errors, strings.TrimSpace(string(data[1:])))
+			return
+		}
+	}
+
+	line := strings.TrimSuffix(string(data), "\n")
+
+	if t.advertisingCapabilities {
+		t.capabilities = append(t.capabilities, line)
+		return
+	}
+
+	// The first ref, want or command carries the capabilities after a NUL
+	// or, for wants, after the object id
+	line, capabilities, found := strings.Cut(line, "\x00")
+	if found {
+		t.capabilities = append(t.capabilities, strings.Fields(capabilities)...)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(line, "ERR "):
+		t.errors = append(t.errors, strings.TrimPrefix(line, "ERR "))
+	case strings.HasPrefix(line, "# service="):
+		// Tells the client it is talking to a smart server
+	case line == "version 2":
+		t.advertisingCapabilities = true
+	case strings.HasPrefix(line, "command="):
+		t.commands = append(t.commands, strings.TrimPrefix(line, "command="))
+	case fields[0] == "want" && len(fields) > 1:
+		t.wants++
+		if len(t.wantIDs) < maxTracedWants {
+			t.wantIDs = append(t.wantIDs, fields[1])
+		}
+		t.capabilities = append(t.capabilities, fields[2:]...)
+	case fields[0] == "have":
+		t.haves++
+	case line == "packfile", line == "NAK", fields[0] == "ACK" && len(fields) == 2:
+		// The pack follows, multiplexed when a sideband was negotiated
+		t.sideband = true
+	case fields[0] == "ng":
+		t.errors = append(t.errors, strings.TrimPrefix(line, "ng "))
+	case len(fields) >= 3 && isObjectID(fields[0]) && isObjectID(fields[1]):
+		t.updates = append(t.updates, fields[2]+" "+fields[0]+".."+fields[1])
+	case len(fields) >= 2 && isObjectID(fields[0]):
+		t.refs++
+	}
+}
+
+func isObjectID(field string) bool {
+	if len(field) != 40 && len(field) != 64 {
+		return false
+	}
+
+	_, err := hex.DecodeString(field)
+	return err == nil
+}
+
+// Log the summary of everything written so far
+func (t *Tracer) Close() error {
+	attributes := []any{"packets", t.packets}
+
+	for _, attribute := range []struct {
+		key   string
+		value any
+		set   bool
+	}{
+		{"refs", t.refs, t.refs > 0},
+		{"capabilities", t.capabilities, len(t.capabilities) > 0},
+		{"commands", t.commands, len(t.commands) > 0},
+		{"wants", t.wants, t.wants > 0},
+		{"want_ids", t.wantIDs, t.wants > 0},
+		{"haves", t.haves, t.haves > 0},
+		{"updates", t.updates, len(t.updates) > 0},
+		{"errors", t.errors, len(t.errors) > 0},
+		{"progress_messages", t.progress, t.progress > 0},
+		{"pack_bytes", t.packBytes, t.packBytes > 0},
+	} {
+		if attribute.set {
+			attributes = append(attributes, attribute.key, attribute.value)
+		}
+	}
+
+	if len(t.pending) > 0 {
+		attributes = append(attributes, "truncated_bytes", len(t.pending))
+	}
+
+	t.logger.Debug("git packet trace", attributes...)
+	return nil
+}
@@ -0,0 +1,116 @@
+package pktline
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	oldID := strings.Repeat("1", 40)
+	newID := strings.Repeat("2", 40)
+
+	tests := []struct {
+		name   string // description of this test case
+		stream func(w *Writer)
+		want   map[string]any
+	}{
+		{
+			name: "ref advertisement",
+			stream: func(w *Writer) {
+				w.WriteString("# service=git-upload-pack\n")
+				w.WriteFlush()
+				w.WriteString(oldID + " HEAD\x00multi_ack side-band-64k\n")
+				w.WriteString(oldID + " refs/heads/main\n")
+				w.WriteFlush()
+			},
+			want: map[string]any{
+				"packets":      5.0,
+				"refs":         2.0,
+				"capabilities": []any{"multi_ack", "side-band-64k"},
+			},
+		},
+		{
+			name: "version 2 fetch request",
+			stream: func(w *Writer) {
+				w.WriteString("command=fetch")
+				w.WriteString("agent=git/2.39.5")
+				w.WriteDelim()
+				w.WriteString("want " + newID + "\n")
+				w.WriteString("have " + oldID + "\n")
+				w.WriteString("done\n")
+				w.WriteFlush()
+			},
+			want: map[string]any{
+				"packets":  7.0,
+				"commands": []any{"fetch"},
+				"wants":    1.0,
+				"want_ids": []any{newID},
+				"haves":    1.0,
+			},
+		},
+		{
+			name: "fetch response with sideband pack",
+			stream: func(w *Writer) {
+				w.WriteString("NAK\n")
+				w.Sideband(SidebandProgress).Write([]byte("Counting objects: 3\r"))
+				w.Sideband(SidebandData).Write([]byte("PACK0123456789"))
+				w.Sideband(SidebandError).Write([]byte("out of memory\n"))
+				w.WriteFlush()
+			},
+			want: map[string]any{
+				"packets":           5.0,
+				"errors":            []any{"out of memory"},
+				"progress_messages": 1.0,
+				"pack_bytes":        14.0,
+			},
+		},
+		{
+			name: "push request with raw pack",
+			stream: func(w *Writer) {
+				w.WriteString(oldID + " " + newID + " refs/heads/main\x00report-status\n")
+				w.WriteFlush()
+				w.writer.Write([]byte("PACK0123456789"))
+			},
+			want: map[string]any{
+				"packets":      2.0,
+				"capabilities": []any{"report-status"},
+				"updates":      []any{"refs/heads/main " + oldID + ".." + newID},
+				"pack_bytes":   14.0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			tt.stream(NewWriter(&stream))
+
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			tracer := NewTracer(logger)
+
+			// Written in awkward pieces, the way a stream arrives
+			for chunk := range slices.Chunk(stream.Bytes(), 3) {
+				tracer.Write(chunk)
+			}
+			tracer.Close()
+
+			var got map[string]any
+			err := json.Unmarshal(logs.Bytes(), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delete(got, "time")
+			delete(got, "level")
+			delete(got, "msg")
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("traced %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package protection
+
+import (
+	"context"
+	"fmt"
+	"gitgud/config"
+	"gitgud/git"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Branch protection rule read from the repository config, e.g.
+//
+//	[protect "main"]
+//		allowForcePush = false
+//		allowDeletion = false
+//		pusher = alice
+//		pusher = bob
+//
+// The pattern is matched against branch names with path.Match. Force pushes
+// and deletions are denied unless allowed, and when pushers are listed only
+// they may push.
+type Rule struct {
+	Pattern        string
+	AllowForcePush bool
+	AllowDeletion  bool
+	Pushers        []string
+}
+
+func (r Rule) Matches(branchName string) bool {
+	matched, err := path.Match(r.Pattern, branchName)
+	return err == nil && matched
+}
+
+func LoadRules(ctx context.Context, repo git.GitRepository) ([]Rule, error) {
+	entries, err := repo.GetConfigRegexp(ctx, `^protect\.`)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []Rule{}
+	for _, entry := range entries {
+		subsection := strings.TrimPrefix(entry.Key, "protect.")
+		dot := strings.LastIndex(subsection, ".")
+		if dot < 0 {
+			continue
+		}
+		pattern, key := subsection[:dot], subsection[dot+1:]
+
+		index := slices.IndexFunc(rules, func(r Rule) bool { return r.Pattern == pattern })
+		if index < 0 {
+			rules = append(rules, Rule{Pattern: pattern})
+			index = len(rules) - 1
+		}
+
+		// git lowercases the key names it lists
+		switch key {
+		case "allowforcepush":
+			rules[index].AllowForcePush, err = parseBool(entry.Value)
+		case "allowdeletion":
+			rules[index].AllowDeletion, err = parseBool(entry.Value)
+		case "pusher":
+			rules[index].Pushers = append(rules[index].Pushers, entry.Value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", entry.Key, err)
+		}
+	}
+
+	return rules, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean %q", value)
+	}
+}
+
+type RefUpdate struct {
+	RefName string
+	OldID   string
+	NewID   string
+}
+
+func isZeroID(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
+
+// Check an update by pusher against the rules, the returned error explains
+// why the update was rejected.
+func Check(ctx context.Context, repo git.GitRepository, rules []Rule, pusher string, update RefUpdate) error {
+	branchName, isBranch := strings.CutPrefix(update.RefName, "refs/heads/")
+	if !isBranch {
+		return nil
+	}
+
+	for _, rule := range rules {
+		if !rule.Matches(branchName) {
+			continue
+		}
+
+		if len(rule.Pushers) > 0 && !slices.Contains(rule.Pushers, pusher) {
+			return fmt.Errorf("protected branch %s: %s is not allowed to push, only %s", branchName, pusher, strings.Join(rule.Pushers, ", "))
+		}
+
+		if isZeroID(update.NewID) {
+			if !rule.AllowDeletion {
+				return fmt.Errorf("protected branch %s: deletion is not allowed", branchName)
+			}
+			continue
+		}
+
+		if !isZeroID(update.OldID) && !rule.AllowForcePush {
+			fastForward, err := repo.IsAncestor(ctx, update.OldID, update.NewID)
+			if err != nil {
+				return err
+			}
+
+			if !fastForward {
+				return fmt.Errorf("protected branch %s: force push is not allowed", branchName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Variables carrying the pusher to the update hook and the hooks the
+// repository had before they were replaced, which run after ours
+const (
+	pusherVariable    = "GITGUD_PUSHER"
+	hooksPathVariable = "GITGUD_HOOKS_PATH"
+)
+
+// Hooks receive-pack runs in bare repositories, all of them lead to the
+// repository's own
+var receiveHooks = []string{
+	"pre-receive",
+	"update",
+	"proc-receive",
+	"post-receive",
+	"post-update",
+	"reference-transaction",
+	"pre-auto-gc",
+}
+
+// Return the environment receive-pack needs to enforce the branch protection
+// of the repository for pusher, nothing when the repository has no rules.
+// Enforcement happens in the update hook, where the pushed objects are
+// available to tell force pushes apart. The config is added to any
+// GIT_CONFIG_COUNT entries of the environment rather than replacing them.
+func Environment(ctx context.Context, repo git.GitRepository, pusher string) ([]string, error) {
+	rules, err := LoadRules(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	repoHooksPath, err := hooksPath(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	hooksPath, err := installHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	if value := os.Getenv("GIT_CONFIG_COUNT"); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid GIT_CONFIG_COUNT %q", value)
+		}
+	}
+
+	return []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", count+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=core.hooksPath", count),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, hooksPath),
+		hooksPathVariable + "=" + repoHooksPath,
+		pusherVariable + "=" + pusher,
+	}, nil
+}
+
+// Absolute directory the hooks of the repository are in, core.hooksPath
+// when set
+func hooksPath(ctx context.Context, repo git.GitRepository) (string, error) {
+	path, err := repo.HooksPath(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(repo.FullPath, path)
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve hooks path: %w", err)
+	}
+
+	return path, nil
+}
+
+var installHooksOnce = sync.OnceValues(func() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find executable for hooks: %w", err)
+	}
+
+	hooksPath, err := filepath.Abs(filepath.Join(config.Settings.RepositoriesLocation, ".hooks"))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve hooks path: %w", err)
+	}
+
+	err = os.MkdirAll(hooksPath, 0750)
+	if err != nil {
+		return "", fmt.Errorf("failed to create hooks path: %w", err)
+	}
+
+	for _, name := range receiveHooks {
+		script := "#!/bin/sh\n"
+		if name == "update" {
+			// Single quote the executable for the shell, quotes inside it
+			// become '\''
+			script += fmt.Sprintf("'%s' hook update \"$@\" || exit 1\n", strings.ReplaceAll(executable, "'", `'\''`))
+		}
+
+		// git doesn't mind hooks leaving the input it sends them unread
+		script += fmt.Sprintf("hook=\"$%s/%s\"\ntest -x \"$hook\" || exit 0\nexec \"$hook\" \"$@\"\n", hooksPathVariable, name)
+
+		err = os.WriteFile(filepath.Join(hooksPath, name), []byte(script), 0750)
+		if err != nil {
+			return "", fmt.Errorf("failed to write %s hook: %w", name, err)
+		}
+	}
+
+	return hooksPath, nil
+})
+
+// Write the hooks that run this binary before the repository's own, once per
+// process so they always point at the running executable
+func installHooks() (string, error) {
+	return installHooksOnce()
+}
+
+// Run as the update hook of receive-pack from within the repository,
+// returning why the update is rejected.
+func RunUpdateHook(ctx context.Context, refName, oldID, newID string) error {
+	repo := git.GitRepository{FullPath: "."}
+
+	rules, err := LoadRules(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	return Check(ctx, repo, rules, os.Getenv(pusherVariable), RefUpdate{refName, oldID, newID})
+}
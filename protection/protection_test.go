@@ -0,0 +1,168 @@
+package protection
+
+import (
+	"context"
+	"gitgud/git"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadRules(t *testing.T) {
+	g, err := git.NewRemoteRepository("", "test_org", "test_repo_protection")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.DeleteRepo(context.Background())
+
+	for _, entry := range [][2]string{
+		{"protect.main.pusher", "alice"},
+		{"protect.release/1.x.allowForcePush", "true"},
+	} {
+		err = g.SetConfig(context.Background(), entry[0], entry[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := LoadRules(context.Background(), g.GitRepository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Rule{
+		{Pattern: "main", Pushers: []string{"alice"}},
+		{Pattern: "release/1.x", AllowForcePush: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadRules() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	zeroID := strings.Repeat("0", 40)
+	someID := strings.Repeat("a", 40)
+
+	rules := []Rule{
+		{Pattern: "main", Pushers: []string{"alice"}},
+		{Pattern: "release/*"},
+		{Pattern: "feature/*", AllowDeletion: true},
+	}
+
+	tests := []struct {
+		name    string // description of this test case
+		pusher  string
+		update  RefUpdate
+		wantErr bool
+	}{
+		{
+			name:   "unprotected branch",
+			pusher: "bob",
+			update: RefUpdate{"refs/heads/topic", someID, zeroID},
+		},
+		{
+			name:   "tags are not protected",
+			pusher: "bob",
+			update: RefUpdate{"refs/tags/main", someID, zeroID},
+		},
+		{
+			name:   "allowed pusher creates branch",
+			pusher: "alice",
+			update: RefUpdate{"refs/heads/main", zeroID, someID},
+		},
+		{
+			name:    "other pusher",
+			pusher:  "bob",
+			update:  RefUpdate{"refs/heads/main", zeroID, someID},
+			wantErr: true,
+		},
+		{
+			name:    "deletion",
+			pusher:  "bob",
+			update:  RefUpdate{"refs/heads/release/1.x", someID, zeroID},
+			wantErr: true,
+		},
+		{
+			name:   "allowed deletion",
+			pusher: "bob",
+			update: RefUpdate{"refs/heads/feature/thing", someID, zeroID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := Check(context.Background(), git.GitRepository{}, rules, tt.pusher, tt.update)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("Check() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("Check() succeeded unexpectedly")
+			}
+		})
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	g, err := git.NewRemoteRepository("", "test_org", "test_repo_environment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.DeleteRepo(context.Background())
+
+	got, err := Environment(context.Background(), g.GitRepository, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("Environment() without rules = %v, want nil", got)
+	}
+
+	err = g.SetConfig(context.Background(), "protect.main.pusher", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Config already passed through the environment
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "core.hooksPath")
+	t.Setenv("GIT_CONFIG_VALUE_0", "custom_hooks")
+
+	got, err = Environment(context.Background(), g.GitRepository, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooksPath, err := installHooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repoHooksPath, err := filepath.Abs(filepath.Join(g.FullPath, "custom_hooks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_1=core.hooksPath",
+		"GIT_CONFIG_VALUE_1=" + hooksPath,
+		"GITGUD_HOOKS_PATH=" + repoHooksPath,
+		"GITGUD_PUSHER=alice",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Environment() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"gitgud/config"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type mountURLKey struct{}
+
+// Proxies trusted with the X-Forwarded headers
+type trustedProxies struct {
+	prefixes []netip.Prefix
+	unix     bool
+}
+
+func parseTrustedProxies(entries []string) trustedProxies {
+	var proxies trustedProxies
+	for _, entry := range entries {
+		if entry == "unix" {
+			proxies.unix = true
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			address, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				slog.Error("ignoring invalid trusted proxy", "proxy", entry, "error", err)
+				continue
+			}
+			prefix = netip.PrefixFrom(address, address.BitLen())
+		}
+
+		proxies.prefixes = append(proxies.prefixes, prefix)
+	}
+
+	return proxies
+}
+
+func (p trustedProxies) trusts(request *http.Request) bool {
+	addrPort, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err != nil {
+		// Connections to the Unix socket have no address to speak of
+		local, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		return p.unix && ok && local.Network() == "unix"
+	}
+
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addrPort.Addr().Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Mount next under the base path of settings, answering 404 for anything
+// outside of it. Requests carry the URL the routes are reachable at, see
+// mountURL.
+func mountRouter(next http.Handler, settings config.ServerSettings) http.Handler {
+	mountPath := settings.MountPath()
+	proxies := parseTrustedProxies(settings.TrustedProxies)
+
+	if mountPath != "" {
+		next = http.StripPrefix(mountPath, next)
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if mountPath != "" && !strings.HasPrefix(request.URL.Path, mountPath+"/") {
+			http.NotFound(writer, request)
+			return
+		}
+
+		baseURL := strings.TrimSuffix(config.Settings.BaseURL, "/") + mountPath
+		if proxies.trusts(request) {
+			baseURL = forwardedURL(request, baseURL, mountPath)
+		}
+
+		ctx := context.WithValue(request.Context(), mountURLKey{}, baseURL)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Replace the scheme, host and prefix of baseURL with the ones a proxy
+// forwarded, keeping what it left out or got wrong. Proxies in a chain each
+// add their value, the first is the one the client used.
+func forwardedURL(request *http.Request, baseURL, mountPath string) string {
+	forwarded := func(header string) string {
+		value, _, _ := strings.Cut(request.Header.Get(header), ",")
+		return strings.TrimSpace(value)
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL
+	}
+
+	if proto := forwarded("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		base.Scheme = proto
+	}
+
+	if host := forwarded("X-Forwarded-Host"); host != "" {
+		parsed, err := url.Parse("//" + host)
+		if err == nil && parsed.Host == host && parsed.User == nil {
+			base.Host = host
+		}
+	}
+
+	if prefix := forwarded("X-Forwarded-Prefix"); strings.HasPrefix(prefix, "/") {
+		base.Path = strings.TrimSuffix(path.Clean(prefix), "/") + mountPath
+	}
+
+	return base.String()
+}
+
+// URL the routes are reachable at for the client that sent request
+func mountURL(request *http.Request) string {
+	baseURL, ok := request.Context().Value(mountURLKey{}).(string)
+	if !ok {
+		return config.Settings.MountURL()
+	}
+
+	return baseURL
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gitgud/config"
+	"gitgud/limit"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Cause of the cancellation of whatever is still running once the grace
+// period of a shutdown is over
+var errShutdown = errors.New("server shutting down")
+
+// How long cancelled git services get to exit, they are killed if they
+// ignore SIGTERM for longer
+const cancelledServicesTimeout = 10 * time.Second
+
+// Fail readiness for the drain delay, then stop accepting connections and
+// give running requests and git services the grace period to finish.
+// Whatever still runs after it is cancelled, and the repositories it was
+// running for are logged.
+func shutdown(servers []*http.Server, listeners []io.Closer, cancelServices context.CancelCauseFunc) {
+	services := limit.DefaultServices()
+	gracePeriod := config.Settings.Server.ShutdownGracePeriod
+
+	slog.Info("shutting down", "grace_period", gracePeriod, "busy_repositories", services.Busy())
+
+	shuttingDown.Store(true)
+	if delay := config.Settings.Server.ShutdownDrainDelay; delay > 0 {
+		slog.Info("failing readiness before closing listeners", "delay", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	for _, listener := range listeners {
+		err := listener.Close()
+		if err != nil {
+			slog.Error("failed to close listener", "error", err)
+		}
+	}
+
+	var err error
+	for _, server := range servers {
+		err = errors.Join(err, server.Shutdown(ctx))
+	}
+
+	// Services run over ssh:// and git:// aren't requests the servers wait on
+	if err == nil {
+		err = services.Wait(ctx)
+	}
+
+	if err == nil {
+		slog.Info("shutdown complete")
+		return
+	}
+
+	slog.Warn("grace period over, cancelling running services", "busy_repositories", services.Busy())
+	cancelServices(errShutdown)
+
+	ctx, cancel = context.WithTimeout(context.Background(), cancelledServicesTimeout)
+	defer cancel()
+
+	err = services.Wait(ctx)
+	if err != nil {
+		slog.Error("services still running after being cancelled", "busy_repositories", services.Busy())
+	}
+
+	for _, server := range servers {
+		server.Close()
+	}
+}
@@ -0,0 +1,412 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gitgud/auth"
+	"gitgud/config"
+	"gitgud/git"
+	"gitgud/limit"
+	"gitgud/netserver"
+	"gitgud/protection"
+	"gitgud/webhook"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Server for git over ssh://, clients authenticate with a public key and run
+// git-upload-pack or git-receive-pack as an exec request on a session.
+type Server struct {
+	Settings config.SSHSettings
+
+	netserver.Server
+
+	serverConfig *ssh.ServerConfig
+	users        *auth.UserStore
+}
+
+func NewServer(settings config.SSHSettings) (*Server, error) {
+	hostKey, err := loadHostKey(settings.HostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{Settings: settings, users: auth.NewUserStore(config.Settings.Auth.UsersPath)}
+	server.serverConfig = &ssh.ServerConfig{
+		PublicKeyCallback: server.authenticate,
+	}
+	server.serverConfig.AddHostKey(hostKey)
+
+	return server, nil
+}
+
+// Load the private host key from path, generating a new ed25519 key when it
+// doesn't exist yet.
+func loadHostKey(path string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("generating ssh host key", "path", path)
+
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate host key: %w", err)
+		}
+
+		block, err := ssh.MarshalPrivateKey(privateKey, "gitgud host key")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal host key: %w", err)
+		}
+
+		pemBytes = pem.EncodeToMemory(block)
+		err = os.WriteFile(path, pemBytes, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write host key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+
+	hostKey, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key %s: %w", path, err)
+	}
+
+	return hostKey, nil
+}
+
+// Accept keys listed in the authorized keys file with a gitgud-user option
+// naming the user they belong to, e.g.
+//
+//	gitgud-user="nunya" ssh-ed25519 AAAA... nunya@laptop
+//
+// Keys without one, or naming a user that doesn't exist, are refused. Lines
+// that don't parse are logged and skipped. The file is read on every attempt
+// so keys can be added and removed without a restart.
+func (s *Server) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	authorizedKeys, err := os.ReadFile(s.Settings.AuthorizedKeysPath)
+	if err != nil {
+		slog.Error("failed to read authorized keys", "path", s.Settings.AuthorizedKeysPath, "error", err)
+		return nil, fmt.Errorf("no authorized keys")
+	}
+
+	for number, line := range strings.Split(string(authorizedKeys), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		authorizedKey, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			slog.Warn("skipping invalid authorized key", "path", s.Settings.AuthorizedKeysPath, "line", number+1, "error", err)
+			continue
+		}
+
+		if !slices.Equal(authorizedKey.Marshal(), key.Marshal()) {
+			continue
+		}
+
+		name, ok := keyUser(options)
+		if !ok {
+			slog.Warn("authorized key without a gitgud-user option", "path", s.Settings.AuthorizedKeysPath, "line", number+1)
+			continue
+		}
+
+		user, err := s.users.Lookup(name)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			slog.Warn("authorized key of unknown user", "path", s.Settings.AuthorizedKeysPath, "line", number+1, "user", name)
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to look up user of authorized key", "user", name, "error", err)
+			return nil, fmt.Errorf("failed to look up user")
+		}
+
+		return &ssh.Permissions{
+			Extensions: map[string]string{
+				"user":        user.Name,
+				"fingerprint": ssh.FingerprintSHA256(key),
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown public key for %s", conn.User())
+}
+
+// Name in the gitgud-user option of an authorized key
+func keyUser(options []string) (string, bool) {
+	for _, option := range options {
+		value, found := strings.CutPrefix(option, "gitgud-user=")
+		if !found {
+			continue
+		}
+
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		return value, value != ""
+	}
+
+	return "", false
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Settings.Address)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Listening for ssh", "address", listener.Addr())
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	return s.Server.Serve(listener, s.handleConnection)
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.serverConfig)
+	if err != nil {
+		slog.Debug("ssh handshake failed", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	defer serverConn.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			slog.Error("failed to accept ssh channel", "error", err)
+			continue
+		}
+
+		go s.handleSession(serverConn, channel, requests)
+	}
+}
+
+// Serve a session until its exec request has run, GIT_PROTOCOL is the only
+// environment variable taken from the client.
+func (s *Server) handleSession(conn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	gitProtocol := ""
+	for request := range requests {
+		switch request.Type {
+		case "env":
+			var env struct {
+				Name  string
+				Value string
+			}
+			err := ssh.Unmarshal(request.Payload, &env)
+			if err != nil || env.Name != "GIT_PROTOCOL" {
+				request.Reply(false, nil)
+				continue
+			}
+
+			gitProtocol = env.Value
+			request.Reply(true, nil)
+		case "exec":
+			var execRequest struct {
+				Command string
+			}
+			err := ssh.Unmarshal(request.Payload, &execRequest)
+			if err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+
+			go ssh.DiscardRequests(requests)
+
+			exitStatus := s.runService(conn, channel, execRequest.Command, gitProtocol)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{exitStatus}))
+			return
+		case "shell":
+			fmt.Fprintf(channel.Stderr(), "Hi %s! gitgud does not provide shell access.\n", conn.Permissions.Extensions["user"])
+			request.Reply(true, nil)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			return
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// Run the git service named in command with the channel as its stdin and
+// stdout, returning the exit status for the client.
+func (s *Server) runService(conn *ssh.ServerConn, channel ssh.Channel, command string, gitProtocol string) uint32 {
+	service, remoteRepo, err := parseCommand(command)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "fatal: %s\n", err)
+		return 128
+	}
+
+	slog.Info("ssh service",
+		"user", conn.Permissions.Extensions["user"],
+		"fingerprint", conn.Permissions.Extensions["fingerprint"],
+		"service", service,
+		"path", remoteRepo.FullPath,
+	)
+
+	user := auth.User{Name: conn.Permissions.Extensions["user"]}
+	level, err := auth.RepositoryAccess(s.Context(), remoteRepo, &user)
+	if err != nil {
+		slog.Error("failed to check repository access", "error", err)
+		fmt.Fprintln(channel.Stderr(), "fatal: internal server error")
+		return 128
+	}
+
+	required := auth.ReadAccess
+	if service == "git-receive-pack" {
+		required = auth.WriteAccess
+	}
+
+	if level == auth.NoAccess {
+		// Same answer as a missing repository
+		fmt.Fprintln(channel.Stderr(), "fatal: Repository not found.")
+		return 128
+	}
+
+	if level < required {
+		fmt.Fprintf(channel.Stderr(), "fatal: Permission to %s/%s denied to %s.\n", remoteRepo.OrgName, remoteRepo.Name, user.Name)
+		return 128
+	}
+
+	protocolVersion, err := git.NegotiateProtocolVersion(service, gitProtocol, config.Settings.Server.ProtocolVersions)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "fatal: %s\n", err)
+		return 128
+	}
+	remoteRepo.ProtocolVersion = protocolVersion
+
+	// The service is cancelled when the connection drops or it runs too long
+	ctx, disconnect := context.WithCancelCause(s.Context())
+	defer disconnect(nil)
+	go func() {
+		disconnect(fmt.Errorf("ssh connection closed: %w", conn.Wait()))
+	}()
+
+	services := limit.DefaultServices()
+	release, err := services.Acquire(ctx, service, remoteRepo)
+	if errors.Is(err, limit.ErrBusy) {
+		fmt.Fprintf(channel.Stderr(), "fatal: server busy, try again in %s\n", services.Settings.RetryAfter)
+		return 128
+	}
+	if err != nil {
+		slog.Info("ssh service cancelled while queued", "service", service, "path", remoteRepo.FullPath, "reason", err)
+		return 128
+	}
+	defer release()
+
+	ctx, cancel := git.WithServiceTimeout(ctx, service, false)
+	defer cancel()
+
+	serviceCommand := remoteRepo.CallServiceStream(ctx, service)
+
+	var push *webhook.Push
+	if service == "git-receive-pack" {
+		protectionEnv, err := protection.Environment(ctx, remoteRepo.GitRepository, user.Name)
+		if err != nil {
+			slog.Error("failed to load branch protection", "error", err)
+			fmt.Fprintln(channel.Stderr(), "fatal: internal server error")
+			return 128
+		}
+		serviceCommand.Env = append(serviceCommand.Env, protectionEnv...)
+
+		push, err = webhook.BeginPush(ctx, remoteRepo, user.Name)
+		if err != nil {
+			slog.Error("failed to load webhooks", "error", err)
+			fmt.Fprintln(channel.Stderr(), "fatal: internal server error")
+			return 128
+		}
+	}
+	serviceCommand.Stdout = channel
+	serviceCommand.Stderr = channel.Stderr()
+
+	// Copy stdin by hand, the client keeps its side open until it has seen
+	// the exit status so waiting on it would never finish
+	stdin, err := serviceCommand.StdinPipe()
+	if err != nil {
+		slog.Error("failed to open service stdin", "error", err)
+		return 1
+	}
+
+	wait, err := git.Start(serviceCommand)
+	if err != nil {
+		slog.Error("failed to start service", "service", service, "error", err)
+		return 1
+	}
+
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	err = wait()
+
+	if cause := context.Cause(ctx); cause != nil {
+		slog.Info("ssh service cancelled", "service", service, "path", remoteRepo.FullPath, "reason", cause)
+		fmt.Fprintf(channel.Stderr(), "fatal: %s\n", cause)
+		return 128
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.ExitCode())
+	}
+
+	if err != nil {
+		slog.Error("failure calling service", "service", service, "error", err)
+		return 1
+	}
+
+	if push != nil {
+		err = push.Finish(ctx, webhook.DefaultQueue())
+		if err != nil {
+			slog.Error("failed to queue webhooks", "error", err)
+		}
+	}
+
+	return 0
+}
+
+// Parse an exec command such as git-upload-pack 'org/repo.git' into the
+// service and the repository it addresses.
+func parseCommand(command string) (string, git.GitRemoteRepository, error) {
+	service, path, found := strings.Cut(command, " ")
+	if !found || !slices.Contains([]string{"git-upload-pack", "git-receive-pack"}, service) {
+		return "", git.GitRemoteRepository{}, fmt.Errorf("unexpected command: %s", command)
+	}
+
+	// git single quotes the path, escaping quotes inside it as '\''
+	if len(path) >= 2 && strings.HasPrefix(path, "'") && strings.HasSuffix(path, "'") {
+		path = strings.ReplaceAll(path[1:len(path)-1], `'\''`, "'")
+	}
+
+	remoteRepo, err := git.NewRemoteRepositoryFromPath(config.Settings.MountURL(), path)
+	if err != nil {
+		return "", git.GitRemoteRepository{}, err
+	}
+
+	return service, remoteRepo, nil
+}
@@ -0,0 +1,348 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"gitgud/auth"
+	"gitgud/config"
+	"gitgud/git"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Add the user nunya to the user store
+func newTestUser(t *testing.T) {
+	t.Helper()
+
+	err := auth.NewUserStore(config.Settings.Auth.UsersPath).SetPassword("nunya", "bidness")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Remove(config.Settings.Auth.UsersPath) })
+}
+
+// Start a server on a random local port that authorizes the returned signer
+func newTestServer(t *testing.T) (string, ssh.Signer) {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	settings := config.SSHSettings{
+		HostKeyPath:        filepath.Join(directory, "host_key"),
+		AuthorizedKeysPath: filepath.Join(directory, "authorized_keys"),
+	}
+
+	newTestUser(t)
+
+	authorizedKey := `gitgud-user="nunya" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " nunya@laptop\n"
+	err = os.WriteFile(settings.AuthorizedKeysPath, []byte(authorizedKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Serve(listener)
+
+	return listener.Addr().String(), signer
+}
+
+func TestServer_UploadPack(t *testing.T) {
+	address, signer := newTestServer(t)
+
+	testRepo, err := git.NewRemoteRepository("", "test_org", "test_repo_ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	err = testRepo.SetConfig(context.Background(), "access.nunya.level", "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	err = session.Setenv("GIT_PROTOCOL", "version=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A flush packet ends the version 2 session straight after the
+	// capability advertisement
+	session.Stdin = strings.NewReader("0000")
+	var stdOut bytes.Buffer
+	session.Stdout = &stdOut
+
+	err = session.Run("git-upload-pack 'test_org/test_repo_ssh.git'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "000eversion 2\n"
+	if !strings.HasPrefix(stdOut.String(), expected) {
+		t.Fatalf("advertisement -> expected prefix: %q, got %q", expected, stdOut.String())
+	}
+}
+
+func TestServer_UnknownKey(t *testing.T) {
+	address, _ := newTestServer(t)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("ssh.Dial() succeeded with an unknown key")
+	}
+}
+
+// Connection of a client logging in as git
+type testConn struct {
+	ssh.ConnMetadata
+}
+
+func (testConn) User() string {
+	return "git"
+}
+
+func TestServer_authenticate(t *testing.T) {
+	newTestUser(t)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	tests := []struct {
+		name           string
+		authorizedKeys string
+		wantUser       string
+		wantErr        bool
+	}{
+		{
+			name:           "gitgud-user option",
+			authorizedKeys: `gitgud-user="nunya" ` + key + " nunya@laptop\n",
+			wantUser:       "nunya",
+		},
+		{
+			name:           "invalid lines before the key",
+			authorizedKeys: "# keys of nunya\nnot a key\n\n" + `gitgud-user="nunya" ` + key + "\n",
+			wantUser:       "nunya",
+		},
+		{
+			name:           "comment only",
+			authorizedKeys: key + " nunya\n",
+			wantErr:        true,
+		},
+		{
+			name:           "unknown user",
+			authorizedKeys: `gitgud-user="mallory" ` + key + "\n",
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory := t.TempDir()
+			settings := config.SSHSettings{
+				HostKeyPath:        filepath.Join(directory, "host_key"),
+				AuthorizedKeysPath: filepath.Join(directory, "authorized_keys"),
+			}
+
+			err := os.WriteFile(settings.AuthorizedKeysPath, []byte(tt.authorizedKeys), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server, err := NewServer(settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			permissions, gotErr := server.authenticate(testConn{}, signer.PublicKey())
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("authenticate() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("authenticate() succeeded unexpectedly")
+			}
+			if permissions.Extensions["user"] != tt.wantUser {
+				t.Errorf("authenticate() user = %q, want %q", permissions.Extensions["user"], tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name        string // description of this test case
+		command     string
+		wantService string
+		wantOrg     string
+		wantRepo    string
+		wantErr     bool
+	}{
+		{
+			name:        "scp style path",
+			command:     "git-upload-pack 'test_org/test_repo.git'",
+			wantService: "git-upload-pack",
+			wantOrg:     "test_org",
+			wantRepo:    "test_repo",
+		},
+		{
+			name:        "ssh url path",
+			command:     "git-receive-pack '/test_org/test_repo.git'",
+			wantService: "git-receive-pack",
+			wantOrg:     "test_org",
+			wantRepo:    "test_repo",
+		},
+		{
+			name:        "path without suffix",
+			command:     "git-upload-pack 'test_org/test_repo'",
+			wantService: "git-upload-pack",
+			wantOrg:     "test_org",
+			wantRepo:    "test_repo",
+		},
+		{
+			name:    "unexpected service",
+			command: "rm -rf '/'",
+			wantErr: true,
+		},
+		{
+			name:    "path outside the org",
+			command: "git-upload-pack '/test_org/../../etc.git'",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotService, gotRepo, gotErr := parseCommand(tt.command)
+			if gotErr != nil {
+				if !tt.wantErr {
+					t.Errorf("parseCommand() failed: %v", gotErr)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("parseCommand() succeeded unexpectedly")
+			}
+			if gotService != tt.wantService || gotRepo.OrgName != tt.wantOrg || gotRepo.Name != tt.wantRepo {
+				t.Errorf("parseCommand() = %v %v/%v, want %v %v/%v", gotService, gotRepo.OrgName, gotRepo.Name, tt.wantService, tt.wantOrg, tt.wantRepo)
+			}
+		})
+	}
+}
+
+func TestServer_ReceivePackDenied(t *testing.T) {
+	address, signer := newTestServer(t)
+
+	testRepo, err := git.NewRemoteRepository("", "test_org", "test_repo_ssh_denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testRepo.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRepo.DeleteRepo(context.Background())
+
+	err = testRepo.SetConfig(context.Background(), "access.nunya.level", "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var stdErr bytes.Buffer
+	session.Stderr = &stdErr
+
+	err = session.Run("git-receive-pack 'test_org/test_repo_ssh_denied.git'")
+	if err == nil {
+		t.Fatal("receive-pack succeeded with read access")
+	}
+
+	expected := "Permission to test_org/test_repo_ssh_denied denied to nunya."
+	if !strings.Contains(stdErr.String(), expected) {
+		t.Errorf("stderr -> expected: %q, got %q", expected, stdErr.String())
+	}
+}
@@ -0,0 +1,333 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitgud/atomicfile"
+	"gitgud/config"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Delivered Status = "delivered"
+	Failed    Status = "failed"
+)
+
+type Attempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Single event on its way to a webhook. The payload is signed when queued so
+// the secret never touches the disk.
+type Delivery struct {
+	ID            string          `json:"id"`
+	Hook          string          `json:"hook"`
+	URL           string          `json:"url"`
+	Repository    string          `json:"repository"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Signature     string          `json:"signature,omitempty"`
+	Status        Status          `json:"status"`
+	CreatedAt     time.Time       `json:"created_at"`
+	NextAttemptAt time.Time       `json:"next_attempt_at,omitzero"`
+	Attempts      []Attempt       `json:"attempts"`
+}
+
+// Deliveries waiting to be sent are kept as one JSON file each in pending,
+// they move to log once delivered or given up on.
+type Queue struct {
+	Settings config.WebhookSettings
+	Client   *http.Client
+
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+func NewQueue(settings config.WebhookSettings) *Queue {
+	return &Queue{
+		Settings: settings,
+		Client:   &http.Client{Timeout: settings.Timeout},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+var defaultQueue = sync.OnceValue(func() *Queue {
+	return NewQueue(config.Settings.Webhooks)
+})
+
+// Queue shared by every listener accepting pushes
+func DefaultQueue() *Queue {
+	return defaultQueue()
+}
+
+func (q *Queue) pendingPath() string {
+	return filepath.Join(q.Settings.QueuePath, "pending")
+}
+
+func (q *Queue) logPath() string {
+	return filepath.Join(q.Settings.QueuePath, "log")
+}
+
+// Signature of payload sent in the X-Gitgud-Signature-256 header
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (q *Queue) Enqueue(hook Hook, event PushEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode push event: %w", err)
+	}
+
+	now := time.Now().UTC()
+	delivery := Delivery{
+		// Sortable by the time it was queued
+		ID:            fmt.Sprintf("%d-%s", now.UnixNano(), strings.ToLower(rand.Text()[:8])),
+		Hook:          hook.Name,
+		URL:           hook.URL,
+		Repository:    event.Repository.FullName,
+		Event:         "push",
+		Payload:       payload,
+		Status:        Pending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		Attempts:      []Attempt{},
+	}
+	if hook.Secret != "" {
+		delivery.Signature = Sign(hook.Secret, payload)
+	}
+
+	err = q.save(q.pendingPath(), delivery)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("webhook queued", "id", delivery.ID, "hook", hook.Name, "repository", delivery.Repository, "ref", event.Ref)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Deliver everything that is due, forever, every poll interval or as soon as
+// something is queued.
+func (q *Queue) Run() {
+	ticker := time.NewTicker(q.Settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := q.DeliverDue(time.Now())
+		if err != nil {
+			slog.Error("failed to deliver webhooks", "error", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// Attempt every pending delivery whose next attempt is due at now.
+func (q *Queue) DeliverDue(now time.Time) error {
+	deliveries, err := q.load(q.pendingPath())
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		if delivery.NextAttemptAt.After(now) {
+			continue
+		}
+
+		err = q.attempt(delivery, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *Queue) attempt(delivery Delivery, now time.Time) error {
+	attempt := q.send(delivery)
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	switch {
+	case attempt.Error == "":
+		delivery.Status = Delivered
+		delivery.NextAttemptAt = time.Time{}
+	case len(delivery.Attempts) >= q.Settings.MaxAttempts:
+		delivery.Status = Failed
+		delivery.NextAttemptAt = time.Time{}
+	default:
+		// Back off exponentially, 1, 2, 4... times the retry delay
+		backoff := q.Settings.RetryDelay << (len(delivery.Attempts) - 1)
+		delivery.NextAttemptAt = now.Add(backoff)
+	}
+
+	slog.Info("webhook attempt",
+		"id", delivery.ID,
+		"hook", delivery.Hook,
+		"repository", delivery.Repository,
+		"status", delivery.Status,
+		"status_code", attempt.StatusCode,
+		"error", attempt.Error,
+	)
+
+	if delivery.Status == Pending {
+		return q.save(q.pendingPath(), delivery)
+	}
+
+	err := q.save(q.logPath(), delivery)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(q.pendingPath(), delivery.ID+".json"))
+	if err != nil {
+		return fmt.Errorf("failed to remove delivered webhook: %w", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) send(delivery Delivery) (attempt Attempt) {
+	attempt.At = time.Now().UTC()
+	defer func() { attempt.Duration = time.Since(attempt.At) }()
+
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "gitgud-webhook")
+	request.Header.Set("X-Gitgud-Event", delivery.Event)
+	request.Header.Set("X-Gitgud-Delivery", delivery.ID)
+	if delivery.Signature != "" {
+		request.Header.Set("X-Gitgud-Signature-256", delivery.Signature)
+	}
+
+	response, err := q.Client.Do(request)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	attempt.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected status %s", response.Status)
+	}
+
+	return attempt
+}
+
+// Return the deliveries of the repository named org/repo, pending or not,
+// newest first.
+func (q *Queue) Log(repository string) ([]Delivery, error) {
+	pending, err := q.load(q.pendingPath())
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := q.load(q.logPath())
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := slices.DeleteFunc(append(pending, done...), func(d Delivery) bool {
+		return d.Repository != repository
+	})
+	slices.SortFunc(deliveries, func(a, b Delivery) int { return strings.Compare(b.ID, a.ID) })
+
+	return deliveries, nil
+}
+
+func (q *Queue) load(directory string) ([]Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := os.ReadDir(directory)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Delivery{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook queue: %w", err)
+	}
+
+	deliveries := []Delivery{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		contents, err := os.ReadFile(filepath.Join(directory, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook delivery: %w", err)
+		}
+
+		var delivery Delivery
+		err = json.Unmarshal(contents, &delivery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook delivery %s: %w", entry.Name(), err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// Write the delivery by renaming a complete file over the old one, a crash
+// never leaves half a delivery behind
+func (q *Queue) save(directory string, delivery Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Indenting would also reformat the signed payload
+	contents, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook delivery: %w", err)
+	}
+
+	err = os.MkdirAll(directory, 0750)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook queue: %w", err)
+	}
+
+	err = atomicfile.WriteFile(filepath.Join(directory, delivery.ID+".json"), contents)
+	if err != nil {
+		return fmt.Errorf("failed to save webhook delivery: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"context"
+	"gitgud/git"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Webhook read from the repository config, e.g.
+//
+//	[webhook "ci"]
+//		url = https://ci.example.com/hooks/gitgud
+//		secret = s3cret
+//
+// Every push is POSTed to the url, signed with the secret when one is set.
+type Hook struct {
+	Name   string
+	URL    string
+	Secret string
+}
+
+func LoadHooks(ctx context.Context, repo git.GitRepository) ([]Hook, error) {
+	entries, err := repo.GetConfigRegexp(ctx, `^webhook\.`)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []Hook{}
+	for _, entry := range entries {
+		subsection := strings.TrimPrefix(entry.Key, "webhook.")
+		dot := strings.LastIndex(subsection, ".")
+		if dot < 0 {
+			continue
+		}
+		name, key := subsection[:dot], subsection[dot+1:]
+
+		index := slices.IndexFunc(hooks, func(h Hook) bool { return h.Name == name })
+		if index < 0 {
+			hooks = append(hooks, Hook{Name: name})
+			index = len(hooks) - 1
+		}
+
+		switch key {
+		case "url":
+			hooks[index].URL = entry.Value
+		case "secret":
+			hooks[index].Secret = entry.Value
+		}
+	}
+
+	// A hook without somewhere to send to is half configured
+	return slices.DeleteFunc(hooks, func(h Hook) bool { return h.URL == "" }), nil
+}
+
+// Commits listed in a single push event, the rest are left out
+const maxPushCommits = 20
+
+type PushEvent struct {
+	Ref        string     `json:"ref"`
+	Before     string     `json:"before"`
+	After      string     `json:"after"`
+	Created    bool       `json:"created"`
+	Deleted    bool       `json:"deleted"`
+	Repository Repository `json:"repository"`
+	Pusher     Pusher     `json:"pusher"`
+	Commits    []Commit   `json:"commits"`
+}
+
+type Repository struct {
+	Name     string `json:"name"`
+	Org      string `json:"org"`
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+}
+
+type Pusher struct {
+	Name string `json:"name"`
+}
+
+type Commit struct {
+	ID        string    `json:"id"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	Author    Author    `json:"author"`
+}
+
+type Author struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Push in progress, refs are compared before and after receive-pack to find
+// out what it updated.
+type Push struct {
+	remoteRepo git.GitRemoteRepository
+	pusher     string
+	hooks      []Hook
+	before     map[string]string
+}
+
+// Record the refs of the repository ahead of a push by pusher. Repositories
+// without webhooks skip the work and Finish does nothing.
+func BeginPush(ctx context.Context, remoteRepo git.GitRemoteRepository, pusher string) (*Push, error) {
+	hooks, err := LoadHooks(ctx, remoteRepo.GitRepository)
+	if err != nil {
+		return nil, err
+	}
+
+	push := &Push{remoteRepo: remoteRepo, pusher: pusher, hooks: hooks}
+	if len(hooks) == 0 {
+		return push, nil
+	}
+
+	push.before, err = remoteRepo.GetRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return push, nil
+}
+
+// Queue a delivery to every webhook for each ref the push updated.
+func (p *Push) Finish(ctx context.Context, queue *Queue) error {
+	if len(p.hooks) == 0 {
+		return nil
+	}
+
+	// The push has landed, its event goes out even when the client is gone
+	ctx = context.WithoutCancel(ctx)
+
+	after, err := p.remoteRepo.GetRefs(ctx)
+	if err != nil {
+		return err
+	}
+
+	events, err := p.events(ctx, after)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		for _, hook := range p.hooks {
+			err = queue.Enqueue(hook, event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Push) events(ctx context.Context, after map[string]string) ([]PushEvent, error) {
+	zeroID := strings.Repeat("0", 40)
+
+	refNames := []string{}
+	for refName := range p.before {
+		refNames = append(refNames, refName)
+	}
+	for refName := range after {
+		if _, found := p.before[refName]; !found {
+			refNames = append(refNames, refName)
+		}
+	}
+	slices.Sort(refNames)
+
+	// Commits already reachable before the push aren't new to anyone
+	known := []string{}
+	for _, objectID := range p.before {
+		known = append(known, objectID)
+	}
+
+	repository := Repository{
+		Name:     p.remoteRepo.Name,
+		Org:      p.remoteRepo.OrgName,
+		FullName: p.remoteRepo.OrgName + "/" + p.remoteRepo.Name,
+		CloneURL: p.remoteRepo.CloneURL,
+	}
+
+	events := []PushEvent{}
+	for _, refName := range refNames {
+		beforeID, existed := p.before[refName]
+		afterID, exists := after[refName]
+		if beforeID == afterID {
+			continue
+		}
+
+		event := PushEvent{
+			Ref:        refName,
+			Before:     beforeID,
+			After:      afterID,
+			Created:    !existed,
+			Deleted:    !exists,
+			Repository: repository,
+			Pusher:     Pusher{Name: p.pusher},
+			Commits:    []Commit{},
+		}
+		if !existed {
+			event.Before = zeroID
+		}
+		if !exists {
+			event.After = zeroID
+		}
+
+		if exists {
+			commits, err := p.remoteRepo.GetCommits(ctx, afterID, known, maxPushCommits)
+			if err != nil {
+				return nil, err
+			}
+
+			// Oldest first, the way they were committed
+			for _, commit := range slices.Backward(commits) {
+				event.Commits = append(event.Commits, Commit{
+					ID:        commit.ID,
+					Message:   commit.Message,
+					Timestamp: commit.Timestamp,
+					Author:    Author{Name: commit.AuthorName, Email: commit.AuthorEmail},
+				})
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
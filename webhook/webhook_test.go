@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"gitgud/config"
+	"gitgud/git"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestRepo(t *testing.T, name string) git.GitRemoteRepository {
+	t.Helper()
+
+	g, err := git.NewRemoteRepository("https://gitgud.com", "test_org", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.CreateBareRepo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.DeleteRepo(context.Background()) })
+
+	return g
+}
+
+func pushTestCommits(t *testing.T, remoteRepo git.GitRemoteRepository, messages ...string) {
+	t.Helper()
+
+	localRemote := remoteRepo
+	localRemote.CloneURL = remoteRepo.FullPath
+
+	clonedRepo, err := localRemote.Clone(context.Background(), remoteRepo.Name+"_local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clonedRepo.DeleteRepo(context.Background())
+
+	for _, entry := range [][2]string{{"user.name", "Nunya Bidness"}, {"user.email", "nunya@bidness.com"}} {
+		err = clonedRepo.SetConfig(context.Background(), entry[0], entry[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, message := range messages {
+		err = os.WriteFile(clonedRepo.FullPath+"/README.md", []byte(message), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = clonedRepo.AddAll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = clonedRepo.Commit(context.Background(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = clonedRepo.Push(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestQueue(t *testing.T) *Queue {
+	settings := config.Settings.Webhooks
+	settings.QueuePath = t.TempDir()
+	return NewQueue(settings)
+}
+
+func TestLoadHooks(t *testing.T) {
+	g := createTestRepo(t, "test_repo_webhooks")
+
+	for _, entry := range [][2]string{
+		{"webhook.ci.url", "https://ci.example.com"},
+		{"webhook.ci.secret", "s3cret"},
+		{"webhook.chat.url", "https://chat.example.com"},
+		{"webhook.unfinished.secret", "s3cret"},
+	} {
+		err := g.SetConfig(context.Background(), entry[0], entry[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := LoadHooks(context.Background(), g.GitRepository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Hook{
+		{Name: "ci", URL: "https://ci.example.com", Secret: "s3cret"},
+		{Name: "chat", URL: "https://chat.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadHooks() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPush(t *testing.T) {
+	g := createTestRepo(t, "test_repo_webhook_push")
+
+	received := make(chan *http.Request, 1)
+	payloads := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		payloads <- body
+	}))
+	defer receiver.Close()
+
+	err := g.SetConfig(context.Background(), "webhook.ci.url", receiver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.SetConfig(context.Background(), "webhook.ci.secret", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := newTestQueue(t)
+
+	push, err := BeginPush(context.Background(), g, "nunya")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushTestCommits(t, g, "First", "Second")
+
+	err = push.Finish(context.Background(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = queue.DeliverDue(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-received
+	payload := <-payloads
+
+	if got := request.Header.Get("X-Gitgud-Event"); got != "push" {
+		t.Errorf("X-Gitgud-Event = %q, want push", got)
+	}
+
+	if got, want := request.Header.Get("X-Gitgud-Signature-256"), Sign("s3cret", payload); got != want {
+		t.Errorf("X-Gitgud-Signature-256 = %q, want %q", got, want)
+	}
+
+	var event PushEvent
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Ref != "refs/heads/main" || !event.Created || event.Before != strings.Repeat("0", 40) {
+		t.Errorf("unexpected ref update %s %s..%s created=%v", event.Ref, event.Before, event.After, event.Created)
+	}
+
+	if event.Repository.FullName != "test_org/test_repo_webhook_push" || event.Pusher.Name != "nunya" {
+		t.Errorf("unexpected repository %+v or pusher %+v", event.Repository, event.Pusher)
+	}
+
+	if len(event.Commits) != 2 || event.Commits[0].Message != "First" || event.Commits[1].ID != event.After {
+		t.Errorf("unexpected commits %+v", event.Commits)
+	}
+
+	deliveries, err := queue.Log("test_org/test_repo_webhook_push")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].Status != Delivered {
+		t.Errorf("Log() = %+v, want a single delivered delivery", deliveries)
+	}
+}
+
+func TestQueue_Retry(t *testing.T) {
+	failures := 2
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer receiver.Close()
+
+	queue := newTestQueue(t)
+	queue.Settings.MaxAttempts = 3
+	queue.Settings.RetryDelay = time.Minute
+
+	event := PushEvent{Ref: "refs/heads/main", Repository: Repository{FullName: "test_org/test_repo"}}
+	err := queue.Enqueue(Hook{Name: "ci", URL: receiver.URL}, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, step := range []struct {
+		at           time.Time
+		wantStatus   Status
+		wantAttempts int
+	}{
+		{at: now, wantStatus: Pending, wantAttempts: 1},
+		// Not due until a minute after the first attempt
+		{at: now.Add(30 * time.Second), wantStatus: Pending, wantAttempts: 1},
+		{at: now.Add(90 * time.Second), wantStatus: Pending, wantAttempts: 2},
+		// Then two minutes after the second
+		{at: now.Add(3 * time.Minute), wantStatus: Pending, wantAttempts: 2},
+		{at: now.Add(4 * time.Minute), wantStatus: Delivered, wantAttempts: 3},
+	} {
+		err = queue.DeliverDue(step.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deliveries, err := queue.Log("test_org/test_repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(deliveries) != 1 {
+			t.Fatalf("Log() returned %d deliveries, want 1", len(deliveries))
+		}
+
+		if deliveries[0].Status != step.wantStatus || len(deliveries[0].Attempts) != step.wantAttempts {
+			t.Errorf("at %v: status %s after %d attempts, want %s after %d",
+				step.at.Sub(now), deliveries[0].Status, len(deliveries[0].Attempts), step.wantStatus, step.wantAttempts)
+		}
+	}
+}
+
+func TestQueue_GiveUp(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	queue := newTestQueue(t)
+	queue.Settings.MaxAttempts = 2
+	queue.Settings.RetryDelay = 0
+
+	event := PushEvent{Ref: "refs/heads/main", Repository: Repository{FullName: "test_org/test_repo"}}
+	err := queue.Enqueue(Hook{Name: "ci", URL: receiver.URL}, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		err = queue.DeliverDue(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveries, err := queue.Log("test_org/test_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].Status != Failed || len(deliveries[0].Attempts) != 2 {
+		t.Fatalf("Log() = %+v, want one failed delivery after 2 attempts", deliveries)
+	}
+
+	if deliveries[0].Attempts[1].StatusCode != http.StatusInternalServerError {
+		t.Errorf("attempt status code = %d, want 500", deliveries[0].Attempts[1].StatusCode)
+	}
+}